@@ -0,0 +1,151 @@
+package sentencepiece
+
+// Side selects the end of a sequence which is truncated or padded
+type Side int
+
+// Sides of a sequence. DefaultSide is the right side, unless a post processor
+// expects padding on another side.
+const (
+	DefaultSide Side = iota
+	Right
+	Left
+)
+
+// Padding selects the length sequences of a batch are padded to
+type Padding int
+
+// Padding strategies
+const (
+	NoPadding Padding = iota
+	PadToLongest
+	PadToMaxLength
+)
+
+// BatchOptions controls how a batch of texts is encoded. Sequences longer
+// than MaxLength, when it is set, are truncated on the TruncationSide; the
+// BOS and EOS pieces are always kept. Truncation selects the texts truncated
+// in pairs. Padded lengths are rounded up to a multiple of PadToMultipleOf
+// when it is set.
+type BatchOptions struct {
+	EncodeOptions
+	MaxLength       int
+	TruncationSide  Side
+	Truncation      TruncationStrategy
+	Padding         Padding
+	PaddingSide     Side
+	PadToMultipleOf int
+}
+
+// BatchEncoding holds the encoded sequences of a batch
+type BatchEncoding struct {
+	InputIDs      [][]int32
+	AttentionMask [][]int32
+	TokenTypeIDs  [][]int32
+	Offsets       [][]TokenOffset
+}
+
+// EncodeBatch encodes texts into sequences of ids with the same length when
+// padding is enabled. Padding uses the pad piece of the model, or id 0 if the
+// model has none.
+func (s *Sentencepiece) EncodeBatch(texts []string, opts BatchOptions) BatchEncoding {
+	sequences := make([][]TokenOffset, len(texts))
+	for i, text := range texts {
+		tokens := s.encodeWithoutBOSAndEOS(text, opts.EncodeOptions)
+		if opts.MaxLength > 0 {
+			tokens = truncate(tokens, opts.MaxLength-s.countBOSAndEOS(opts.EncodeOptions), opts.TruncationSide)
+		}
+		sequences[i] = s.addBOSAndEOS(tokens, opts.EncodeOptions, s.textLength(text))
+	}
+	typeIDs := make([][]int32, len(sequences))
+	for i, tokens := range sequences {
+		typeIDs[i] = make([]int32, len(tokens))
+	}
+	return s.padBatch(sequences, typeIDs, 0, opts)
+}
+
+// padBatch pads the sequences and their token type ids, and builds the batch
+func (s *Sentencepiece) padBatch(sequences [][]TokenOffset, typeIDs [][]int32, padTypeID int32, opts BatchOptions) BatchEncoding {
+	length := paddedLength(sequences, opts)
+	padToken := s.padToken()
+	batch := BatchEncoding{
+		InputIDs:      make([][]int32, len(sequences)),
+		AttentionMask: make([][]int32, len(sequences)),
+		TokenTypeIDs:  make([][]int32, len(sequences)),
+		Offsets:       make([][]TokenOffset, len(sequences)),
+	}
+	for i, tokens := range sequences {
+		padding := 0
+		if length > len(tokens) {
+			padding = length - len(tokens)
+		}
+		size := len(tokens) + padding
+		ids := make([]int32, 0, size)
+		mask := make([]int32, 0, size)
+		types := make([]int32, 0, size)
+		offsets := make([]TokenOffset, 0, size)
+		pad := func() {
+			for j := 0; j < padding; j++ {
+				ids = append(ids, padToken.ID)
+				mask = append(mask, 0)
+				types = append(types, padTypeID)
+				offsets = append(offsets, padToken)
+			}
+		}
+		if opts.PaddingSide == Left {
+			pad()
+		}
+		for j, token := range tokens {
+			ids = append(ids, token.ID)
+			mask = append(mask, 1)
+			types = append(types, typeIDs[i][j])
+			offsets = append(offsets, token)
+		}
+		if opts.PaddingSide != Left {
+			pad()
+		}
+		batch.InputIDs[i] = ids
+		batch.AttentionMask[i] = mask
+		batch.TokenTypeIDs[i] = types
+		batch.Offsets[i] = offsets
+	}
+	return batch
+}
+
+func (s *Sentencepiece) padToken() TokenOffset {
+	if s.pad >= 0 {
+		return s.controlToken(s.pad, 0)
+	}
+	return TokenOffset{}
+}
+
+func paddedLength(sequences [][]TokenOffset, opts BatchOptions) int {
+	length := 0
+	switch opts.Padding {
+	case NoPadding:
+		return 0
+	case PadToMaxLength:
+		length = opts.MaxLength
+	}
+	for _, tokens := range sequences {
+		if len(tokens) > length {
+			length = len(tokens)
+		}
+	}
+	if multiple := opts.PadToMultipleOf; multiple > 0 && length%multiple != 0 {
+		length += multiple - length%multiple
+	}
+	return length
+}
+
+func truncate(tokens []TokenOffset, length int, side Side) []TokenOffset {
+	if length < 0 {
+		length = 0
+	}
+	if len(tokens) <= length {
+		return tokens
+	}
+	if side == Left {
+		return tokens[len(tokens)-length:]
+	}
+	return tokens[:length]
+}
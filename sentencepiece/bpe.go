@@ -0,0 +1,143 @@
+package sentencepiece
+
+import (
+	"container/heap"
+	"math/rand"
+)
+
+type bpeSymbol struct {
+	start int
+	end   int
+	prev  int
+	next  int
+}
+
+type bpePair struct {
+	left  int
+	right int
+	score float32
+	size  int
+}
+
+// bpeAgenda is a max-heap of pairs ordered by score, and by position for
+// pairs with the same score.
+type bpeAgenda []bpePair
+
+func (a bpeAgenda) Len() int { return len(a) }
+
+func (a bpeAgenda) Less(i, j int) bool {
+	if a[i].score != a[j].score {
+		return a[i].score > a[j].score
+	}
+	return a[i].left < a[j].left
+}
+
+func (a bpeAgenda) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+
+func (a *bpeAgenda) Push(x interface{}) { *a = append(*a, x.(bpePair)) }
+
+func (a *bpeAgenda) Pop() interface{} {
+	old := *a
+	n := len(old)
+	pair := old[n-1]
+	*a = old[:n-1]
+	return pair
+}
+
+// EncodeWithDropout tokenizes text with BPE-dropout, skipping each merge with
+// probability p. Models which are not BPE models are tokenized deterministically.
+func (s *Sentencepiece) EncodeWithDropout(text string, p float32, rng *rand.Rand) []TokenOffset {
+	if s.modelType != TrainerSpec_BPE {
+		return s.TokenizeToOffsets(text)
+	}
+	randFloat := rand.Float64
+	if rng != nil {
+		randFloat = rng.Float64
+	}
+	return s.encodeText(text, func(runes []rune) []slice {
+		return s.encodeBPE(runes, float64(p), randFloat)
+	})
+}
+
+// encodeBPE segments runes by repeatedly merging the adjacent pair of symbols
+// whose concatenation is the piece with the highest score. Each merge is
+// skipped with probability dropout.
+func (s *Sentencepiece) encodeBPE(runes []rune, dropout float64, randFloat func() float64) []slice {
+	symbols := make([]bpeSymbol, len(runes))
+	for i := range runes {
+		symbols[i] = bpeSymbol{start: i, end: i + 1, prev: i - 1, next: i + 1}
+	}
+	if len(symbols) > 0 {
+		symbols[len(symbols)-1].next = -1
+	}
+
+	// reverseMerges records for unused pieces the length of the left part
+	// they were merged from.
+	reverseMerges := make(map[string]int)
+	agenda := &bpeAgenda{}
+	addPair := func(left, right int) {
+		if left == -1 || right == -1 {
+			return
+		}
+		start, end := symbols[left].start, symbols[right].end
+		word := string(runes[start:end])
+		index, ok := s.lookupMergePiece(word)
+		if !ok {
+			return
+		}
+		heap.Push(agenda, bpePair{left: left, right: right, score: s.pieces[index].score, size: end - start})
+		if s.pieces[index].typ == ModelProto_SentencePiece_UNUSED {
+			reverseMerges[word] = symbols[left].end - start
+		}
+	}
+	for i := 1; i < len(symbols); i++ {
+		addPair(i-1, i)
+	}
+
+	for agenda.Len() > 0 {
+		pair := heap.Pop(agenda).(bpePair)
+		left, right := &symbols[pair.left], &symbols[pair.right]
+		if left.start == left.end || right.start == right.end ||
+			(left.end-left.start)+(right.end-right.start) != pair.size {
+			continue
+		}
+		if dropout > 0 && (dropout >= 1 || randFloat() < dropout) {
+			continue
+		}
+		left.end = right.end
+		left.next = right.next
+		if right.next >= 0 {
+			symbols[right.next].prev = pair.left
+		}
+		right.start, right.end = 0, 0
+		addPair(left.prev, pair.left)
+		addPair(pair.left, left.next)
+	}
+
+	slices := make([]slice, 0, len(symbols))
+	for i := 0; i != -1 && len(symbols) > 0; i = symbols[i].next {
+		symbol := symbols[i]
+		slices = s.appendBPESlices(slices, runes, symbol.start, symbol.end, reverseMerges)
+	}
+	return slices
+}
+
+// appendBPESlices appends the slice for the piece runes[start:end]. Unused
+// pieces can only be produced by merges, so they are split back into the
+// pieces they were merged from, and are unknown when they are single runes.
+func (s *Sentencepiece) appendBPESlices(slices []slice, runes []rune, start, end int, reverseMerges map[string]int) []slice {
+	word := string(runes[start:end])
+	index, ok := s.lookupMergePiece(word)
+	if !ok {
+		return append(slices, slice{index: s.unknown, start: start, end: end})
+	}
+	if s.pieces[index].typ == ModelProto_SentencePiece_UNUSED {
+		size, ok := reverseMerges[word]
+		if !ok {
+			return append(slices, slice{index: s.unknown, start: start, end: end})
+		}
+		slices = s.appendBPESlices(slices, runes, start, start+size, reverseMerges)
+		return s.appendBPESlices(slices, runes, start+size, end, reverseMerges)
+	}
+	return append(slices, slice{score: s.pieces[index].score, index: index, start: start, end: end})
+}
@@ -0,0 +1,87 @@
+package sentencepiece
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseBytePiece returns the byte represented by a piece of the form <0xXX>
+func parseBytePiece(piece string) (byte, bool) {
+	if len(piece) != 6 || !strings.HasPrefix(piece, "<0x") || !strings.HasSuffix(piece, ">") {
+		return 0, false
+	}
+	b, err := strconv.ParseUint(piece[3:5], 16, 8)
+	if err != nil {
+		return 0, false
+	}
+	return byte(b), true
+}
+
+func (s *Sentencepiece) setBytePiece(b byte, index int32) {
+	if s.bytePieces == nil {
+		s.bytePieces = make([]int32, 256)
+		for i := range s.bytePieces {
+			s.bytePieces[i] = -1
+		}
+	}
+	s.bytePieces[b] = index
+}
+
+// fallbackToBytes replaces unknown slices with the byte pieces of the UTF-8
+// encoding of their runes. The last byte piece of every rune spans the rune,
+// the other ones are empty.
+func (s *Sentencepiece) fallbackToBytes(output []slice, slices []slice, runes []rune) []slice {
+	var buf [utf8.UTFMax]byte
+	for _, sl := range slices {
+		if sl.index != s.unknown || !s.hasBytePieces(runes[sl.start:sl.end]) {
+			output = append(output, sl)
+			continue
+		}
+		for i := sl.start; i < sl.end; i++ {
+			n := utf8.EncodeRune(buf[:], runes[i])
+			for j, b := range buf[:n] {
+				end := i + 1
+				if j < n-1 {
+					end = i
+				}
+				output = append(output, slice{index: s.bytePieces[b], start: i, end: end})
+			}
+		}
+	}
+	return output
+}
+
+func (s *Sentencepiece) hasBytePieces(runes []rune) bool {
+	if s.bytePieces == nil {
+		return false
+	}
+	var buf [utf8.UTFMax]byte
+	for _, r := range runes {
+		n := utf8.EncodeRune(buf[:], r)
+		for _, b := range buf[:n] {
+			if s.bytePieces[b] < 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *Sentencepiece) isByteID(id int32) bool {
+	return id >= 0 && int(id) < len(s.pieces) && s.pieces[id].typ == ModelProto_SentencePiece_BYTE
+}
+
+// decodeBytes writes the text of consecutive byte pieces. Bytes which are not
+// part of a valid UTF-8 sequence are written as the replacement character.
+func decodeBytes(sb *strings.Builder, bytes []byte) {
+	for len(bytes) > 0 {
+		r, size := utf8.DecodeRune(bytes)
+		if r == utf8.RuneError && size <= 1 {
+			sb.WriteString(replacementChar)
+		} else {
+			sb.Write(bytes[:size])
+		}
+		bytes = bytes[size:]
+	}
+}
@@ -0,0 +1,10 @@
+package sentencepiece
+
+// encodeChars emits a piece for every rune.
+func (s *Sentencepiece) encodeChars(runes []rune) []slice {
+	slices := make([]slice, len(runes))
+	for i := range runes {
+		slices[i] = s.pieceSlice(runes, i, i+1)
+	}
+	return slices
+}
@@ -0,0 +1,121 @@
+package sentencepiece
+
+import (
+	"sync"
+	"unicode/utf8"
+)
+
+var scratchPool = sync.Pool{
+	New: func() interface{} {
+		return &Scratch{}
+	},
+}
+
+// CountTokens returns the number of tokens of text, without building them
+func (s *Sentencepiece) CountTokens(text string) int {
+	sc := scratchPool.Get().(*Scratch)
+	defer scratchPool.Put(sc)
+	runes, _, symbols := s.normalizeInto(text, sc)
+	return s.countTokens(runes, symbols, sc)
+}
+
+// CountTokensBatch returns the number of tokens of each of texts
+func (s *Sentencepiece) CountTokensBatch(texts []string) []int {
+	sc := scratchPool.Get().(*Scratch)
+	defer scratchPool.Put(sc)
+	counts := make([]int, len(texts))
+	for i, text := range texts {
+		runes, _, symbols := s.normalizeInto(text, sc)
+		counts[i] = s.countTokens(runes, symbols, sc)
+	}
+	return counts
+}
+
+// FitsWithin returns whether text has at most limit tokens. Texts which are
+// short enough once normalized are not segmented at all, and unigram models
+// stop counting once the count exceeds limit.
+func (s *Sentencepiece) FitsWithin(text string, limit int) bool {
+	if limit < 0 {
+		return false
+	}
+	sc := scratchPool.Get().(*Scratch)
+	defer scratchPool.Put(sc)
+	runes, _, symbols := s.normalizeInto(text, sc)
+	if s.maxTokens(runes, limit) <= limit {
+		return true
+	}
+	if s.modelType != TrainerSpec_UNIGRAM {
+		return s.countTokens(runes, symbols, sc) <= limit
+	}
+	return s.countUnigramTokens(runes, symbols, limit, sc) <= limit
+}
+
+func (s *Sentencepiece) countTokens(runes []rune, symbols []slice, sc *Scratch) int {
+	slices := s.segmentRunes(runes, symbols, func(runes []rune) []slice {
+		return s.encodeRunes(runes, sc)
+	}, sc)
+	return len(slices)
+}
+
+// countUnigramTokens counts the tokens of runes by walking the Viterbi
+// slices of the runs between the symbols backwards, from the end of runes. It
+// stops once the count exceeds limit.
+func (s *Sentencepiece) countUnigramTokens(runes []rune, symbols []slice, limit int, sc *Scratch) int {
+	count := 0
+	end := len(runes)
+	for i := len(symbols) - 1; i >= -1 && count <= limit; i-- {
+		start := 0
+		if i >= 0 {
+			start = symbols[i].end
+		}
+		count += s.countViterbiTokens(runes[start:end], limit-count, sc)
+		if i >= 0 {
+			count++
+			end = symbols[i].start
+		}
+	}
+	return count
+}
+
+// countViterbiTokens counts the tokens of the best segmentation of runes
+// like resolveUnknowns would output them, following the back pointers of the
+// slices without building the segmentation. It stops once the count exceeds
+// limit.
+func (s *Sentencepiece) countViterbiTokens(runes []rune, limit int, sc *Scratch) int {
+	slices := s.decodeForwardToken(runes, sc)
+	count := 0
+	afterUnknown := false
+	for end := len(runes); end > 0 && count <= limit; end = slices[end].start {
+		sl := slices[end]
+		unknown := sl.index == s.unknown
+		switch {
+		case !unknown:
+			count++
+		case s.byteFallback && s.hasBytePieces(runes[sl.start:sl.end]):
+			for _, r := range runes[sl.start:sl.end] {
+				count += utf8.RuneLen(r)
+			}
+		case s.byteFallback || !afterUnknown:
+			count++
+		}
+		afterUnknown = unknown
+	}
+	return count
+}
+
+// maxTokens returns an upper bound of the number of tokens of runes, as every
+// token covers at least a rune, or a byte with byte fallback. It stops
+// counting once the bound exceeds limit.
+func (s *Sentencepiece) maxTokens(runes []rune, limit int) int {
+	if !s.byteFallback {
+		return len(runes)
+	}
+	count := 0
+	for _, r := range runes {
+		count += utf8.RuneLen(r)
+		if count > limit {
+			break
+		}
+	}
+	return count
+}
@@ -0,0 +1,94 @@
+package sentencepiece
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DecodeIDs converts ids from the vocab back into text
+func (s *Sentencepiece) DecodeIDs(ids []int32) (string, error) {
+	pieces := make([]string, len(ids))
+	for i, id := range ids {
+		if id < 0 || int(id) >= len(s.pieces) {
+			return "", fmt.Errorf("Unable to decode id : %d, vocab size %d", id, len(s.pieces))
+		}
+		pieces[i] = s.pieces[id].text
+	}
+	return s.decodePieces(pieces, ids), nil
+}
+
+// DecodePieces converts pieces back into text
+func (s *Sentencepiece) DecodePieces(pieces []string) string {
+	ids := make([]int32, len(pieces))
+	for i, piece := range pieces {
+		ids[i] = s.pieceID(piece)
+	}
+	return s.decodePieces(pieces, ids)
+}
+
+func (s *Sentencepiece) pieceID(piece string) int32 {
+	if id, ok := s.pieceIDs[piece]; ok {
+		return id
+	}
+	if id, ok := s.controlWords[piece]; ok {
+		return id
+	}
+	return s.unknown
+}
+
+func (s *Sentencepiece) decodePieces(pieces []string, ids []int32) string {
+	var sb strings.Builder
+	var bytes []byte
+	isFirst := s.addDummyPrefix || s.removeExtraWhitespaces
+	for i, piece := range pieces {
+		if s.isByteID(ids[i]) {
+			b, _ := parseBytePiece(s.pieces[ids[i]].text)
+			bytes = append(bytes, b)
+			isFirst = false
+			continue
+		}
+		decodeBytes(&sb, bytes)
+		bytes = bytes[:0]
+		sb.WriteString(s.decodePiece(piece, ids[i], isFirst))
+		if !s.isControlID(ids[i]) {
+			isFirst = false
+		}
+	}
+	decodeBytes(&sb, bytes)
+	return sb.String()
+}
+
+func (s *Sentencepiece) decodePiece(piece string, id int32, isFirst bool) string {
+	if s.isControlID(id) {
+		return ""
+	}
+	if id == s.unknown {
+		if piece == s.unknownPiece() {
+			return s.unknownSurface
+		}
+		return piece
+	}
+	if isFirst {
+		piece = strings.TrimPrefix(piece, string(sep))
+	}
+	return strings.ReplaceAll(piece, string(sep), " ")
+}
+
+func (s *Sentencepiece) isControlID(id int32) bool {
+	if id >= 0 && int(id) < len(s.pieces) {
+		return s.pieces[id].typ == ModelProto_SentencePiece_CONTROL
+	}
+	for _, index := range s.controlWords {
+		if index == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Sentencepiece) unknownPiece() string {
+	if s.unknown >= 0 && int(s.unknown) < len(s.pieces) {
+		return s.pieces[s.unknown].text
+	}
+	return unknown
+}
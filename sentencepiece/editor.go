@@ -0,0 +1,201 @@
+package sentencepiece
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ModelEditor edits the pieces of a model. The ids of the pieces are stable:
+// pieces are appended to the vocab, and only the last pieces can be removed.
+// Other pieces are disabled instead, keeping their ids.
+type ModelEditor struct {
+	model *ModelProto
+	ids   map[string]int32
+}
+
+// NewModelEditor returns an editor of model, which is edited in place
+func NewModelEditor(model *ModelProto) (*ModelEditor, error) {
+	e := &ModelEditor{model: model, ids: make(map[string]int32, len(model.GetPieces()))}
+	for i, piece := range model.GetPieces() {
+		if _, ok := e.ids[piece.GetPiece()]; ok {
+			return nil, fmt.Errorf("Unable to edit model : piece %s is duplicated", piece.GetPiece())
+		}
+		e.ids[piece.GetPiece()] = int32(i)
+	}
+	return e, nil
+}
+
+// Edit returns an editor of a copy of the model, whose edits are applied
+// with Apply.
+func (s *Sentencepiece) Edit() (*ModelEditor, error) {
+	return NewModelEditor(s.ModelProto())
+}
+
+// Model returns the edited model
+func (e *ModelEditor) Model() *ModelProto {
+	return e.model
+}
+
+// AddPiece appends piece to the vocab and returns its id
+func (e *ModelEditor) AddPiece(piece string, score float32, typ ModelProto_SentencePiece_Type) (int32, error) {
+	if piece == "" {
+		return -1, fmt.Errorf("Unable to add an empty piece")
+	}
+	if id, ok := e.ids[piece]; ok {
+		return -1, fmt.Errorf("Unable to add piece : %s, already in the vocab with id %d", piece, id)
+	}
+	switch typ {
+	case ModelProto_SentencePiece_UNKNOWN:
+		return -1, fmt.Errorf("Unable to add piece : %s, the vocab has an unknown piece", piece)
+	case ModelProto_SentencePiece_BYTE:
+		if _, ok := parseBytePiece(piece); !ok {
+			return -1, fmt.Errorf("Unable to add byte piece : %s, expected <0xXX>", piece)
+		}
+	}
+	id := int32(len(e.model.Pieces))
+	e.model.Pieces = append(e.model.Pieces, &ModelProto_SentencePiece{
+		Piece: proto.String(piece),
+		Score: proto.Float32(score),
+	})
+	if typ != ModelProto_SentencePiece_NORMAL {
+		e.model.Pieces[id].Type = typ.Enum()
+	}
+	e.ids[piece] = id
+	e.edited()
+	return id, nil
+}
+
+// SetScore sets the score of piece
+func (e *ModelEditor) SetScore(piece string, score float32) error {
+	id, err := e.find(piece)
+	if err != nil {
+		return err
+	}
+	e.model.Pieces[id].Score = proto.Float32(score)
+	e.edited()
+	return nil
+}
+
+// DisablePiece marks piece as unused, so that it is no longer produced by
+// the encoder but keeps its id.
+func (e *ModelEditor) DisablePiece(piece string) error {
+	id, err := e.find(piece)
+	if err != nil {
+		return err
+	}
+	if e.model.Pieces[id].GetType() == ModelProto_SentencePiece_UNKNOWN {
+		return fmt.Errorf("Unable to disable the unknown piece : %s", piece)
+	}
+	e.model.Pieces[id].Type = ModelProto_SentencePiece_UNUSED.Enum()
+	e.edited()
+	return nil
+}
+
+// RemovePiece removes piece from the vocab. Only the last piece can be
+// removed, since removing other pieces would change the ids of the pieces
+// after them.
+func (e *ModelEditor) RemovePiece(piece string) error {
+	id, err := e.find(piece)
+	if err != nil {
+		return err
+	}
+	if int(id) != len(e.model.Pieces)-1 {
+		return fmt.Errorf("Unable to remove piece : %s, id %d is not the last one, disable it instead", piece, id)
+	}
+	if e.model.Pieces[id].GetType() == ModelProto_SentencePiece_UNKNOWN {
+		return fmt.Errorf("Unable to remove the unknown piece : %s", piece)
+	}
+	e.model.Pieces = e.model.Pieces[:id]
+	delete(e.ids, piece)
+	e.edited()
+	return nil
+}
+
+// Validate checks that the pieces are unique, that the vocab has one unknown
+// piece and that the special ids of the trainer spec still match their pieces.
+func (e *ModelEditor) Validate() error {
+	pieces := e.model.GetPieces()
+	seen := make(map[string]bool, len(pieces))
+	unknown := int32(-1)
+	for i, piece := range pieces {
+		word := piece.GetPiece()
+		if word == "" {
+			return fmt.Errorf("Invalid model : piece %d is empty", i)
+		}
+		if seen[word] {
+			return fmt.Errorf("Invalid model : piece %s is duplicated", word)
+		}
+		seen[word] = true
+		switch piece.GetType() {
+		case ModelProto_SentencePiece_UNKNOWN:
+			if unknown >= 0 {
+				return fmt.Errorf("Invalid model : pieces %d and %d are both unknown", unknown, i)
+			}
+			unknown = int32(i)
+		case ModelProto_SentencePiece_BYTE:
+			if _, ok := parseBytePiece(word); !ok {
+				return fmt.Errorf("Invalid model : byte piece %s is not <0xXX>", word)
+			}
+		}
+	}
+	if unknown < 0 {
+		return fmt.Errorf("Invalid model : no unknown piece")
+	}
+
+	spec := e.model.GetTrainerSpec()
+	if spec == nil {
+		return nil
+	}
+	if spec.UnkId != nil && spec.GetUnkId() != unknown {
+		return fmt.Errorf("Invalid model : unk_id %d, unknown piece at %d", spec.GetUnkId(), unknown)
+	}
+	specials := []struct {
+		name string
+		id   *int32
+	}{
+		{"bos_id", spec.BosId},
+		{"eos_id", spec.EosId},
+		{"pad_id", spec.PadId},
+	}
+	for _, special := range specials {
+		if special.id == nil || *special.id < 0 {
+			continue
+		}
+		if int(*special.id) >= len(pieces) || pieces[*special.id].GetType() != ModelProto_SentencePiece_CONTROL {
+			return fmt.Errorf("Invalid model : %s %d is not a control piece", special.name, *special.id)
+		}
+	}
+	return nil
+}
+
+// Apply validates the edited model and rebuilds s from it, keeping the
+// lowercase, user defined, control word and offsets settings of s.
+func (e *ModelEditor) Apply(s *Sentencepiece) error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	edited, err := NewSentencepieceFromModel(e.model, s.lowercase)
+	if err != nil {
+		return err
+	}
+	edited.offsetsMode = s.offsetsMode
+	edited.matchUserDefined = s.matchUserDefined
+	edited.parsedControlWords = s.parsedControlWords
+	edited.buildSymbols()
+	*s = edited
+	return nil
+}
+
+func (e *ModelEditor) find(piece string) (int32, error) {
+	id, ok := e.ids[piece]
+	if !ok {
+		return -1, fmt.Errorf("Unable to find piece : %s", piece)
+	}
+	return id, nil
+}
+
+// edited drops the self test data, whose expected pieces may no longer match
+func (e *ModelEditor) edited() {
+	e.model.SelfTestData = nil
+}
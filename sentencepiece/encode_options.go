@@ -0,0 +1,186 @@
+package sentencepiece
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EncodeOptions controls the pieces added around the tokens of a text, like
+// the extra options of spm_encode. The tokens of the text are reversed before
+// the BOS and EOS pieces are added, as with reverse:bos:eos; other orders are
+// supported by EncodeWithExtraOptions.
+type EncodeOptions struct {
+	AddBOS       bool
+	AddEOS       bool
+	Reverse      bool
+	UnknownPiece bool
+}
+
+// ExtraOption is one of the extra options of spm_encode
+type ExtraOption int
+
+// Extra options
+const (
+	// ExtraBOS adds the BOS piece at the start
+	ExtraBOS ExtraOption = iota
+	// ExtraEOS adds the EOS piece at the end
+	ExtraEOS
+	// ExtraReverse reverses the tokens
+	ExtraReverse
+	// ExtraUnknown uses the unknown piece as the text of unknown tokens
+	ExtraUnknown
+)
+
+var extraOptionNames = map[string]ExtraOption{
+	"bos":     ExtraBOS,
+	"eos":     ExtraEOS,
+	"reverse": ExtraReverse,
+	"unk":     ExtraUnknown,
+}
+
+// ParseExtraOptions parses extra options separated by colons, like
+// "bos:eos:reverse", in the format of spm_encode --extra_options.
+func ParseExtraOptions(options string) ([]ExtraOption, error) {
+	if options == "" {
+		return nil, nil
+	}
+	var parsed []ExtraOption
+	for _, name := range strings.Split(options, ":") {
+		option, ok := extraOptionNames[name]
+		if !ok {
+			return nil, fmt.Errorf("Unable to parse extra option : %s", name)
+		}
+		parsed = append(parsed, option)
+	}
+	return parsed, nil
+}
+
+// GetBOSIndex gets the index of the beginning of sentence piece
+func (s *Sentencepiece) GetBOSIndex() (int32, bool) {
+	return s.bos, s.bos >= 0
+}
+
+// GetEOSIndex gets the index of the end of sentence piece
+func (s *Sentencepiece) GetEOSIndex() (int32, bool) {
+	return s.eos, s.eos >= 0
+}
+
+// GetPadIndex gets the index of the padding piece
+func (s *Sentencepiece) GetPadIndex() (int32, bool) {
+	return s.pad, s.pad >= 0
+}
+
+// Encode tokenizes text into pieces and applies the options. The BOS and EOS
+// pieces are only added when the model has them.
+func (s *Sentencepiece) Encode(text string, opts EncodeOptions) []TokenOffset {
+	tokens := s.encodeWithoutBOSAndEOS(text, opts)
+	return s.addBOSAndEOS(tokens, opts, s.textLength(text))
+}
+
+// EncodeWithExtraOptions tokenizes text into pieces and applies the options
+// in order, like spm_encode, so that bos:eos:reverse gives </s> ... <s>. The
+// BOS and EOS pieces are only added when the model has them.
+func (s *Sentencepiece) EncodeWithExtraOptions(text string, options []ExtraOption) []TokenOffset {
+	tokens := s.TokenizeToOffsets(text)
+	for _, option := range options {
+		switch option {
+		case ExtraBOS:
+			tokens = s.addBOSAndEOS(tokens, EncodeOptions{AddBOS: true}, 0)
+		case ExtraEOS:
+			tokens = s.addBOSAndEOS(tokens, EncodeOptions{AddEOS: true}, s.textLength(text))
+		case ExtraReverse:
+			reverseTokens(tokens)
+		case ExtraUnknown:
+			s.useUnknownPiece(tokens)
+		}
+	}
+	return tokens
+}
+
+func (s *Sentencepiece) encodeWithoutBOSAndEOS(text string, opts EncodeOptions) []TokenOffset {
+	tokens := s.TokenizeToOffsets(text)
+	if opts.UnknownPiece {
+		s.useUnknownPiece(tokens)
+	}
+	if opts.Reverse {
+		reverseTokens(tokens)
+	}
+	return tokens
+}
+
+// useUnknownPiece sets the text of the unknown tokens to the unknown piece
+func (s *Sentencepiece) useUnknownPiece(tokens []TokenOffset) {
+	for i := range tokens {
+		if tokens[i].ID == s.unknown {
+			tokens[i].Text = s.unknownPiece()
+		}
+	}
+}
+
+func reverseTokens(tokens []TokenOffset) {
+	for i, j := 0, len(tokens)-1; i < j; i, j = i+1, j-1 {
+		tokens[i], tokens[j] = tokens[j], tokens[i]
+	}
+}
+
+// addBOSAndEOS adds the BOS and EOS pieces around tokens of a text of the
+// given length in the unit of the offsets.
+func (s *Sentencepiece) addBOSAndEOS(tokens []TokenOffset, opts EncodeOptions, length int) []TokenOffset {
+	if opts.AddBOS && s.bos >= 0 {
+		tokens = append([]TokenOffset{s.controlToken(s.bos, 0)}, tokens...)
+	}
+	if opts.AddEOS && s.eos >= 0 {
+		tokens = append(tokens, s.controlToken(s.eos, length))
+	}
+	return tokens
+}
+
+// countBOSAndEOS returns the number of pieces addBOSAndEOS adds
+func (s *Sentencepiece) countBOSAndEOS(opts EncodeOptions) int {
+	count := 0
+	if opts.AddBOS && s.bos >= 0 {
+		count++
+	}
+	if opts.AddEOS && s.eos >= 0 {
+		count++
+	}
+	return count
+}
+
+// EncodeToIDs tokenizes text into ids from the vocab and applies the options
+func (s *Sentencepiece) EncodeToIDs(text string, opts EncodeOptions) []int32 {
+	tokens := s.Encode(text, opts)
+	ids := make([]int32, len(tokens))
+	for i, token := range tokens {
+		ids[i] = token.ID
+	}
+	return ids
+}
+
+func (s *Sentencepiece) controlToken(id int32, offset int) TokenOffset {
+	return TokenOffset{ID: id, Text: s.pieceText(id), Start: offset, End: offset}
+}
+
+func (s *Sentencepiece) pieceText(id int32) string {
+	if id >= 0 && int(id) < len(s.pieces) {
+		return s.pieces[id].text
+	}
+	for word, index := range s.controlWords {
+		if index == id {
+			return word
+		}
+	}
+	return ""
+}
+
+// specialIndex returns the index given in the trainer spec if it is valid, or
+// else the index of the control piece.
+func (s *Sentencepiece) specialIndex(id int32, piece string) int32 {
+	if id >= 0 && int(id) < len(s.pieces) {
+		return id
+	}
+	if index, ok := s.controlWords[piece]; ok {
+		return index
+	}
+	return -1
+}
@@ -0,0 +1,59 @@
+package sentencepiece
+
+// unknownPenalty is subtracted from the lowest piece score to score the
+// unknown pieces of the lattice.
+const unknownPenalty float32 = 10.0
+
+type latticeNode struct {
+	index int32
+	score float32
+	start int
+	end   int
+}
+
+// lattice holds every piece of the vocab found in the runes, with an unknown
+// piece for each position no single rune piece starts at. The matched symbols
+// are the only pieces over their runes.
+type lattice struct {
+	nodes  []latticeNode
+	endsAt [][]int
+}
+
+func (s *Sentencepiece) buildLattice(runes []rune, symbols []slice) lattice {
+	l := lattice{
+		nodes:  make([]latticeNode, 0, len(runes)*2),
+		endsAt: make([][]int, len(runes)+1),
+	}
+	unknownScore := s.minPieceScore - unknownPenalty
+	for i := 0; i < len(runes); i++ {
+		limit := len(runes)
+		if len(symbols) > 0 {
+			symbol := symbols[0]
+			if symbol.start == i {
+				l.add(latticeNode{index: symbol.index, score: symbol.score, start: symbol.start, end: symbol.end})
+				symbols = symbols[1:]
+				i = symbol.end - 1
+				continue
+			}
+			limit = symbol.start
+		}
+		hasSingleRune := false
+		for _, match := range s.commonPrefixSearch(runes[i:limit]) {
+			l.add(latticeNode{index: match.index, score: match.score, start: i, end: i + match.level})
+			hasSingleRune = hasSingleRune || match.level == 1
+		}
+		if !hasSingleRune {
+			l.add(latticeNode{index: s.unknown, score: unknownScore, start: i, end: i + 1})
+		}
+	}
+	return l
+}
+
+func (l *lattice) add(node latticeNode) {
+	l.endsAt[node.end] = append(l.endsAt[node.end], len(l.nodes))
+	l.nodes = append(l.nodes, node)
+}
+
+func (n latticeNode) slice() slice {
+	return slice{score: n.score, index: n.index, start: n.start, end: n.end}
+}
@@ -0,0 +1,107 @@
+package sentencepiece
+
+import (
+	"container/heap"
+)
+
+type nbestHypothesis struct {
+	node   int
+	parent int
+	pos    int
+	gx     float32
+	fx     float32
+}
+
+// nbestAgenda is a max-heap of hypotheses ordered by their estimated score
+type nbestAgenda struct {
+	hypotheses []nbestHypothesis
+	indices    []int
+}
+
+func (a nbestAgenda) Len() int { return len(a.indices) }
+
+func (a nbestAgenda) Less(i, j int) bool {
+	return a.hypotheses[a.indices[i]].fx > a.hypotheses[a.indices[j]].fx
+}
+
+func (a nbestAgenda) Swap(i, j int) { a.indices[i], a.indices[j] = a.indices[j], a.indices[i] }
+
+func (a *nbestAgenda) Push(x interface{}) { a.indices = append(a.indices, x.(int)) }
+
+func (a *nbestAgenda) Pop() interface{} {
+	n := len(a.indices)
+	index := a.indices[n-1]
+	a.indices = a.indices[:n-1]
+	return index
+}
+
+// NBestTokenize returns up to n segmentations of text with the highest
+// scores, along with their scores, best first. Models which are not unigram
+// models return their only segmentation with a score of 0.
+func (s *Sentencepiece) NBestTokenize(text string, n int) ([][]TokenOffset, []float32) {
+	if n <= 0 {
+		return nil, nil
+	}
+	if s.modelType != TrainerSpec_UNIGRAM {
+		return [][]TokenOffset{s.TokenizeToOffsets(text)}, []float32{0}
+	}
+	runes, offsets, symbols := s.normalizeInto(text, &Scratch{})
+	s.convertOffsets(text, offsets)
+	l := s.buildLattice(runes, symbols)
+	paths, scores := l.nbest(n)
+	tokens := make([][]TokenOffset, len(paths))
+	for i, slices := range paths {
+		slices = s.resolveUnknowns(slices, runes, nil)
+		tokens[i] = s.sliceToTokens(slices, runes, offsets)
+	}
+	return tokens, scores
+}
+
+// nbest finds the n best paths with an A* search running backwards from the
+// end, using the forward Viterbi scores as the estimate of the remaining path.
+func (l *lattice) nbest(n int) ([][]slice, []float32) {
+	length := len(l.endsAt) - 1
+	best := initScores(length + 1)
+	best[0] = 0
+	for pos := 1; pos <= length; pos++ {
+		for _, index := range l.endsAt[pos] {
+			node := l.nodes[index]
+			if score := best[node.start] + node.score; score > best[pos] {
+				best[pos] = score
+			}
+		}
+	}
+
+	agenda := &nbestAgenda{}
+	agenda.hypotheses = append(agenda.hypotheses, nbestHypothesis{node: -1, parent: -1, pos: length, fx: best[length]})
+	heap.Push(agenda, 0)
+
+	var paths [][]slice
+	var scores []float32
+	for agenda.Len() > 0 && len(paths) < n {
+		top := heap.Pop(agenda).(int)
+		hypothesis := agenda.hypotheses[top]
+		if hypothesis.pos == 0 {
+			var path []slice
+			for h := top; agenda.hypotheses[h].node >= 0; h = agenda.hypotheses[h].parent {
+				path = append(path, l.nodes[agenda.hypotheses[h].node].slice())
+			}
+			paths = append(paths, path)
+			scores = append(scores, hypothesis.gx)
+			continue
+		}
+		for _, index := range l.endsAt[hypothesis.pos] {
+			node := l.nodes[index]
+			gx := hypothesis.gx + node.score
+			agenda.hypotheses = append(agenda.hypotheses, nbestHypothesis{
+				node:   index,
+				parent: top,
+				pos:    node.start,
+				gx:     gx,
+				fx:     best[node.start] + gx,
+			})
+			heap.Push(agenda, len(agenda.hypotheses)-1)
+		}
+	}
+	return paths, scores
+}
@@ -0,0 +1,217 @@
+package sentencepiece
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const replacementChar string = "�"
+
+// charsmap holds the precompiled normalization rules of a model. The rules are
+// stored as a Darts double-array trie over the UTF-8 bytes of the input, whose
+// values are offsets of the replacement strings in normalized.
+type charsmap struct {
+	trie       []uint32
+	normalized string
+}
+
+func newCharsmap(blob []byte) (*charsmap, error) {
+	if len(blob) == 0 {
+		return nil, nil
+	}
+	if len(blob) < 4 {
+		return nil, fmt.Errorf("Precompiled charsmap too short : %d bytes", len(blob))
+	}
+	trieSize := int(binary.LittleEndian.Uint32(blob))
+	blob = blob[4:]
+	if trieSize > len(blob) || trieSize%4 != 0 || trieSize == 0 {
+		return nil, fmt.Errorf("Invalid trie size in precompiled charsmap : %d", trieSize)
+	}
+	trie := make([]uint32, trieSize/4)
+	for i := range trie {
+		trie[i] = binary.LittleEndian.Uint32(blob[i*4:])
+	}
+	return &charsmap{trie: trie, normalized: string(blob[trieSize:])}, nil
+}
+
+// normalizePrefix returns the replacement for the longest prefix of text
+// which has a rule, and the number of bytes of text it replaces.
+func (c *charsmap) normalizePrefix(text string) (string, int, bool) {
+	longest := 0
+	value := uint32(0)
+	nodePos := dartsOffset(c.trie[0])
+	for i := 0; i < len(text); i++ {
+		key := uint32(text[i])
+		nodePos ^= key
+		if int(nodePos) >= len(c.trie) {
+			break
+		}
+		unit := c.trie[nodePos]
+		if dartsLabel(unit) != key {
+			break
+		}
+		nodePos ^= dartsOffset(unit)
+		if dartsHasLeaf(unit) && int(nodePos) < len(c.trie) {
+			longest = i + 1
+			value = dartsValue(c.trie[nodePos])
+		}
+	}
+	if longest == 0 || int(value) >= len(c.normalized) {
+		return "", 0, false
+	}
+	replacement := c.normalized[value:]
+	if end := strings.IndexByte(replacement, 0); end >= 0 {
+		replacement = replacement[:end]
+	}
+	return replacement, longest, true
+}
+
+func dartsHasLeaf(unit uint32) bool {
+	return (unit>>8)&1 == 1
+}
+
+func dartsValue(unit uint32) uint32 {
+	return unit & (1<<31 - 1)
+}
+
+func dartsLabel(unit uint32) uint32 {
+	return unit & (1<<31 | 0xFF)
+}
+
+func dartsOffset(unit uint32) uint32 {
+	return (unit >> 10) << ((unit & (1 << 9)) >> 6)
+}
+
+// normalize applies the normalization rules of the model to text. It returns
+// the normalized runes along with, for each of them, the byte offset in text
+// of the input they were produced from. The offsets hold one extra entry for
+// the end of the consumed text. Symbols which are matched as a whole are left
+// as is, and returned as slices of the runes.
+func (s *Sentencepiece) normalize(text string) ([]rune, []int, []slice) {
+	return s.normalizeInto(text, &Scratch{})
+}
+
+// normalizeInto normalizes text into the buffers of sc.
+func (s *Sentencepiece) normalizeInto(text string, sc *Scratch) ([]rune, []int, []slice) {
+	runes, offsets, symbols := sc.runes[:0], sc.offsets[:0], sc.symbols[:0]
+	defer func() {
+		sc.runes, sc.offsets, sc.symbols = runes, offsets, symbols
+	}()
+	space := ' '
+	if s.escapeWhitespaces {
+		space = sep
+	}
+
+	i := 0
+	if s.removeExtraWhitespaces {
+		for i < len(text) {
+			replacement, size := s.normalizePrefix(text[i:])
+			if replacement != " " {
+				break
+			}
+			i += size
+		}
+	}
+	if i == len(text) {
+		offsets = append(offsets, i)
+		return runes, offsets, symbols
+	}
+
+	if s.addDummyPrefix {
+		runes = append(runes, space)
+		offsets = append(offsets, i)
+	}
+
+	isPrevSpace := s.removeExtraWhitespaces
+	for i < len(text) {
+		if symbol, ok := s.matchSymbol(text[i:]); ok {
+			start := len(runes)
+			for _, r := range text[i : i+symbol.end] {
+				runes = append(runes, r)
+				offsets = append(offsets, i)
+			}
+			symbols = append(symbols, slice{score: symbol.score, index: symbol.index, start: start, end: len(runes)})
+			isPrevSpace = false
+			i += symbol.end
+			continue
+		}
+		replacement, size := s.normalizePrefix(text[i:])
+		if isPrevSpace {
+			replacement = strings.TrimLeft(replacement, " ")
+		}
+		if replacement != "" {
+			for _, r := range replacement {
+				if r == ' ' {
+					r = space
+				} else if s.lowercase {
+					r = unicode.ToLower(r)
+				}
+				runes = append(runes, r)
+				offsets = append(offsets, i)
+			}
+			isPrevSpace = strings.HasSuffix(replacement, " ")
+		}
+		i += size
+		if !s.removeExtraWhitespaces {
+			isPrevSpace = false
+		}
+	}
+
+	if s.removeExtraWhitespaces {
+		for len(runes) > 0 && runes[len(runes)-1] == space &&
+			(len(symbols) == 0 || symbols[len(symbols)-1].end < len(runes)) {
+			i = offsets[len(runes)-1]
+			runes = runes[:len(runes)-1]
+			offsets = offsets[:len(runes)]
+		}
+	}
+	offsets = append(offsets, i)
+
+	return runes, offsets, symbols
+}
+
+// normalizePrefix normalizes the first character of text, or a longer prefix
+// if the charsmap has a rule for it.
+func (s *Sentencepiece) normalizePrefix(text string) (string, int) {
+	if s.charsmap != nil {
+		if replacement, size, ok := s.charsmap.normalizePrefix(text); ok {
+			return replacement, size
+		}
+	}
+	r, size := utf8.DecodeRuneInString(text)
+	if r == utf8.RuneError && size <= 1 {
+		return replacementChar, size
+	}
+	if s.charsmap == nil && (isControl(r) || r == 0 || unicode.IsSpace(r)) {
+		return " ", size
+	}
+	return text[:size], size
+}
+
+// Normalize applies the normalization rules of the model to text, returning
+// the text the pieces are matched against.
+func (s *Sentencepiece) Normalize(text string) string {
+	return string(s.prepareFortokenize(text))
+}
+
+func (s *Sentencepiece) prepareFortokenize(text string) []rune {
+	runes, _, _ := s.normalize(text)
+	return runes
+}
+
+// toRuneOffsets converts byte offsets into text, given in increasing order,
+// into rune offsets in place.
+func toRuneOffsets(text string, offsets []int) {
+	pos, count := 0, 0
+	for i, offset := range offsets {
+		for pos < offset {
+			_, size := utf8.DecodeRuneInString(text[pos:])
+			pos += size
+			count++
+		}
+		offsets[i] = count
+	}
+}
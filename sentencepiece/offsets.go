@@ -0,0 +1,70 @@
+package sentencepiece
+
+import "unicode/utf8"
+
+// OffsetsMode selects the unit of the offsets of tokens in the text
+type OffsetsMode int
+
+const (
+	// RuneOffsets counts the runes of the text
+	RuneOffsets OffsetsMode = iota
+	// ByteOffsets counts the bytes of the text, so that offsets can slice it
+	ByteOffsets
+	// UTF16Offsets counts the UTF-16 code units of the text, like the
+	// indices of JavaScript strings
+	UTF16Offsets
+)
+
+// SetOffsetsMode sets the unit of the offsets of tokens, which are runes by
+// default.
+func (s *Sentencepiece) SetOffsetsMode(mode OffsetsMode) {
+	s.offsetsMode = mode
+}
+
+// GetOffsetsMode gets the unit of the offsets of tokens
+func (s *Sentencepiece) GetOffsetsMode() OffsetsMode {
+	return s.offsetsMode
+}
+
+// convertOffsets converts byte offsets in text to the unit of the offsets
+// mode, in place.
+func (s *Sentencepiece) convertOffsets(text string, offsets []int) {
+	switch s.offsetsMode {
+	case ByteOffsets:
+	case UTF16Offsets:
+		toUTF16Offsets(text, offsets)
+	default:
+		toRuneOffsets(text, offsets)
+	}
+}
+
+// textLength returns the length of text in the unit of the offsets mode
+func (s *Sentencepiece) textLength(text string) int {
+	switch s.offsetsMode {
+	case ByteOffsets:
+		return len(text)
+	case UTF16Offsets:
+		offsets := []int{len(text)}
+		toUTF16Offsets(text, offsets)
+		return offsets[0]
+	default:
+		return utf8.RuneCountInString(text)
+	}
+}
+
+// toUTF16Offsets converts sorted byte offsets in text to UTF-16 code unit
+// offsets. Invalid bytes count as one replacement character each.
+func toUTF16Offsets(text string, offsets []int) {
+	pos, count := 0, 0
+	for i, offset := range offsets {
+		for pos < offset {
+			r, size := utf8.DecodeRuneInString(text[pos:])
+			pos += size
+			count++
+			if r >= 0x10000 {
+				count++
+			}
+		}
+		offsets[i] = count
+	}
+}
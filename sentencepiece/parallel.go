@@ -0,0 +1,52 @@
+package sentencepiece
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// TokenizeBatchParallel tokenizes texts with a pool of workers, returning the
+// tokens in the order of texts. It defaults to one worker per CPU when workers
+// is not positive, and stops with the error of ctx once ctx is done.
+func (s *Sentencepiece) TokenizeBatchParallel(ctx context.Context, texts []string, workers int) ([][]TokenOffset, error) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(texts) {
+		workers = len(texts)
+	}
+
+	results := make([][]TokenOffset, len(texts))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			sc := &Scratch{}
+			for i := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				results[i] = s.tokenizeWith(texts[i], sc)
+			}
+		}()
+	}
+
+feed:
+	for i := range texts {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
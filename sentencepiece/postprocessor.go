@@ -0,0 +1,257 @@
+package sentencepiece
+
+import (
+	"fmt"
+)
+
+// TruncationStrategy selects the texts of a pair which are truncated
+type TruncationStrategy int
+
+// Truncation strategies
+const (
+	// LongestFirst removes tokens from the longest text until the pair fits
+	LongestFirst TruncationStrategy = iota
+	// OnlyFirst only truncates the first text
+	OnlyFirst
+	// OnlySecond only truncates the second text
+	OnlySecond
+)
+
+// PostProcessor adds the special pieces a model expects around the tokens of
+// a text, or of a pair of texts.
+type PostProcessor interface {
+	// AddedTokens returns the number of special pieces added
+	AddedTokens(pair bool) int
+	// Process adds the special pieces and returns the tokens with their
+	// segment ids. second is ignored unless pair is set.
+	Process(first, second []TokenOffset, pair bool) ([]TokenOffset, []int32)
+	// PaddingSide returns the side the model expects padding on
+	PaddingSide() Side
+	// PadTypeID returns the segment id of padding
+	PadTypeID() int32
+}
+
+// TemplateItem is either a special piece or one of the texts in a template
+type TemplateItem struct {
+	// Piece is the special piece, or empty for a text
+	Piece string
+	// Text is the index of the text, 0 or 1, when Piece is empty
+	Text   int
+	TypeID int32
+}
+
+// Template describes the special pieces of a model family
+type Template struct {
+	Single      []TemplateItem
+	Pair        []TemplateItem
+	PaddingSide Side
+	PadTypeID   int32
+}
+
+// XLNetTemplate appends <sep> <cls> to texts, with padding on the left
+var XLNetTemplate = Template{
+	Single: []TemplateItem{
+		{Text: 0, TypeID: 0}, {Piece: "<sep>", TypeID: 0}, {Piece: "<cls>", TypeID: 2},
+	},
+	Pair: []TemplateItem{
+		{Text: 0, TypeID: 0}, {Piece: "<sep>", TypeID: 0},
+		{Text: 1, TypeID: 1}, {Piece: "<sep>", TypeID: 1}, {Piece: "<cls>", TypeID: 2},
+	},
+	PaddingSide: Left,
+	PadTypeID:   3,
+}
+
+// ALBERTTemplate encodes texts as [CLS] A [SEP] B [SEP]
+var ALBERTTemplate = Template{
+	Single: []TemplateItem{
+		{Piece: "[CLS]", TypeID: 0}, {Text: 0, TypeID: 0}, {Piece: "[SEP]", TypeID: 0},
+	},
+	Pair: []TemplateItem{
+		{Piece: "[CLS]", TypeID: 0}, {Text: 0, TypeID: 0}, {Piece: "[SEP]", TypeID: 0},
+		{Text: 1, TypeID: 1}, {Piece: "[SEP]", TypeID: 1},
+	},
+}
+
+// T5Template appends </s> to texts
+var T5Template = Template{
+	Single: []TemplateItem{
+		{Text: 0, TypeID: 0}, {Piece: "</s>", TypeID: 0},
+	},
+	Pair: []TemplateItem{
+		{Text: 0, TypeID: 0}, {Piece: "</s>", TypeID: 0},
+		{Text: 1, TypeID: 0}, {Piece: "</s>", TypeID: 0},
+	},
+}
+
+// TemplatePostProcessor is a PostProcessor following a template
+type TemplatePostProcessor struct {
+	template Template
+	tokens   map[string]TokenOffset
+}
+
+// NewTemplatePostProcessor creates a post processor for the template, whose
+// special pieces must be in the vocab of s.
+func NewTemplatePostProcessor(s *Sentencepiece, template Template) (*TemplatePostProcessor, error) {
+	p := &TemplatePostProcessor{template: template, tokens: make(map[string]TokenOffset)}
+	for _, items := range [][]TemplateItem{template.Single, template.Pair} {
+		for _, item := range items {
+			if item.Piece == "" {
+				continue
+			}
+			id, ok := s.controlWords[item.Piece]
+			if !ok {
+				id, ok = s.pieceIDs[item.Piece]
+			}
+			if !ok {
+				return nil, fmt.Errorf("Unable to find special piece : %s", item.Piece)
+			}
+			p.tokens[item.Piece] = TokenOffset{ID: id, Text: item.Piece}
+		}
+	}
+	return p, nil
+}
+
+// NewXLNetPostProcessor creates a post processor for XLNet models
+func NewXLNetPostProcessor(s *Sentencepiece) (*TemplatePostProcessor, error) {
+	return NewTemplatePostProcessor(s, XLNetTemplate)
+}
+
+// NewALBERTPostProcessor creates a post processor for ALBERT models
+func NewALBERTPostProcessor(s *Sentencepiece) (*TemplatePostProcessor, error) {
+	return NewTemplatePostProcessor(s, ALBERTTemplate)
+}
+
+// NewT5PostProcessor creates a post processor for T5 models
+func NewT5PostProcessor(s *Sentencepiece) (*TemplatePostProcessor, error) {
+	return NewTemplatePostProcessor(s, T5Template)
+}
+
+func (p *TemplatePostProcessor) items(pair bool) []TemplateItem {
+	if pair {
+		return p.template.Pair
+	}
+	return p.template.Single
+}
+
+// AddedTokens returns the number of special pieces added
+func (p *TemplatePostProcessor) AddedTokens(pair bool) int {
+	count := 0
+	for _, item := range p.items(pair) {
+		if item.Piece != "" {
+			count++
+		}
+	}
+	return count
+}
+
+// Process adds the special pieces and returns the tokens with their segment ids
+func (p *TemplatePostProcessor) Process(first, second []TokenOffset, pair bool) ([]TokenOffset, []int32) {
+	size := len(first) + len(second) + p.AddedTokens(pair)
+	tokens := make([]TokenOffset, 0, size)
+	typeIDs := make([]int32, 0, size)
+	for _, item := range p.items(pair) {
+		if item.Piece != "" {
+			tokens = append(tokens, p.tokens[item.Piece])
+			typeIDs = append(typeIDs, item.TypeID)
+			continue
+		}
+		text := first
+		if item.Text == 1 {
+			text = second
+		}
+		for _, token := range text {
+			tokens = append(tokens, token)
+			typeIDs = append(typeIDs, item.TypeID)
+		}
+	}
+	return tokens, typeIDs
+}
+
+// PaddingSide returns the side the model expects padding on
+func (p *TemplatePostProcessor) PaddingSide() Side {
+	return p.template.PaddingSide
+}
+
+// PadTypeID returns the segment id of padding
+func (p *TemplatePostProcessor) PadTypeID() int32 {
+	return p.template.PadTypeID
+}
+
+// Encoding holds the ids of a text, or of a pair of texts
+type Encoding struct {
+	InputIDs      []int32
+	AttentionMask []int32
+	TokenTypeIDs  []int32
+	Offsets       []TokenOffset
+}
+
+// EncodeSingle encodes text with the special pieces of p
+func (s *Sentencepiece) EncodeSingle(text string, p PostProcessor, opts BatchOptions) Encoding {
+	return s.EncodeBatchWithPostProcessor([]string{text}, nil, p, opts).encoding(0)
+}
+
+// EncodePair encodes a pair of texts with the special pieces of p
+func (s *Sentencepiece) EncodePair(first, second string, p PostProcessor, opts BatchOptions) Encoding {
+	return s.EncodeBatchWithPostProcessor([]string{first}, []string{second}, p, opts).encoding(0)
+}
+
+// EncodeBatchWithPostProcessor encodes texts with the special pieces of p.
+// When seconds is not nil, it holds the second text of the pair of each of
+// firsts. The BOS and EOS options are ignored as p adds the special pieces;
+// the other options are applied like in EncodeBatch, truncating pairs with
+// the Truncation strategy. Padding uses the segment id of p, and the side of
+// p unless PaddingSide is set.
+func (s *Sentencepiece) EncodeBatchWithPostProcessor(firsts, seconds []string, p PostProcessor, opts BatchOptions) BatchEncoding {
+	pair := seconds != nil
+	opts.AddBOS = false
+	opts.AddEOS = false
+	if opts.PaddingSide == DefaultSide {
+		opts.PaddingSide = p.PaddingSide()
+	}
+	sequences := make([][]TokenOffset, len(firsts))
+	typeIDs := make([][]int32, len(firsts))
+	for i, text := range firsts {
+		first := s.encodeWithoutBOSAndEOS(text, opts.EncodeOptions)
+		var second []TokenOffset
+		if pair && i < len(seconds) {
+			second = s.encodeWithoutBOSAndEOS(seconds[i], opts.EncodeOptions)
+		}
+		if opts.MaxLength > 0 {
+			limit := opts.MaxLength - p.AddedTokens(pair)
+			first, second = truncatePair(first, second, limit, opts.Truncation, opts.TruncationSide)
+		}
+		sequences[i], typeIDs[i] = p.Process(first, second, pair)
+	}
+	return s.padBatch(sequences, typeIDs, p.PadTypeID(), opts)
+}
+
+// truncatePair truncates the tokens of a pair so that both fit in length
+func truncatePair(first, second []TokenOffset, length int, strategy TruncationStrategy, side Side) ([]TokenOffset, []TokenOffset) {
+	if length < 0 {
+		length = 0
+	}
+	switch strategy {
+	case OnlyFirst:
+		return truncate(first, length-len(second), side), second
+	case OnlySecond:
+		return first, truncate(second, length-len(first), side)
+	}
+	firstLength, secondLength := len(first), len(second)
+	for firstLength+secondLength > length {
+		if firstLength > secondLength {
+			firstLength--
+		} else {
+			secondLength--
+		}
+	}
+	return truncate(first, firstLength, side), truncate(second, secondLength, side)
+}
+
+func (b BatchEncoding) encoding(i int) Encoding {
+	return Encoding{
+		InputIDs:      b.InputIDs[i],
+		AttentionMask: b.AttentionMask[i],
+		TokenTypeIDs:  b.TokenTypeIDs[i],
+		Offsets:       b.Offsets[i],
+	}
+}
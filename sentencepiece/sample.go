@@ -0,0 +1,85 @@
+package sentencepiece
+
+import (
+	"math"
+	"math/rand"
+)
+
+// SampleEncode tokenizes text into a segmentation sampled from all the
+// segmentations of the unigram lattice, each with probability proportional
+// to its score scaled by alpha. A small alpha gives more uniform samples.
+// BPE models use alpha as the BPE-dropout probability, and models of other
+// types are tokenized deterministically.
+func (s *Sentencepiece) SampleEncode(text string, alpha float32, rng *rand.Rand) []TokenOffset {
+	if s.modelType == TrainerSpec_BPE {
+		return s.EncodeWithDropout(text, alpha, rng)
+	}
+	if s.modelType != TrainerSpec_UNIGRAM {
+		return s.TokenizeToOffsets(text)
+	}
+	randFloat := rand.Float64
+	if rng != nil {
+		randFloat = rng.Float64
+	}
+	return s.encodeText(text, func(runes []rune) []slice {
+		l := s.buildLattice(runes, nil)
+		return l.sample(float64(alpha), randFloat)
+	})
+}
+
+// sample draws a path by forward filtering the log marginal probability of
+// every position, then sampling the nodes backwards from the end.
+func (l *lattice) sample(theta float64, randFloat func() float64) []slice {
+	alpha := make([]float64, len(l.endsAt))
+	for pos := 1; pos < len(l.endsAt); pos++ {
+		alpha[pos] = math.Inf(-1)
+		for _, n := range l.endsAt[pos] {
+			node := l.nodes[n]
+			alpha[pos] = logSumExp(alpha[pos], alpha[node.start]+theta*float64(node.score))
+		}
+	}
+
+	var reversed []slice
+	probs := make([]float64, 0, 16)
+	for pos := len(l.endsAt) - 1; pos > 0; {
+		probs = probs[:0]
+		total := 0.0
+		for _, n := range l.endsAt[pos] {
+			node := l.nodes[n]
+			prob := math.Exp(alpha[node.start] + theta*float64(node.score) - alpha[pos])
+			probs = append(probs, prob)
+			total += prob
+		}
+		choice := len(probs) - 1
+		target := randFloat() * total
+		for i, prob := range probs {
+			if target < prob {
+				choice = i
+				break
+			}
+			target -= prob
+		}
+		node := l.nodes[l.endsAt[pos][choice]]
+		reversed = append(reversed, node.slice())
+		pos = node.start
+	}
+
+	slices := make([]slice, len(reversed))
+	for i, sl := range reversed {
+		slices[len(reversed)-1-i] = sl
+	}
+	return slices
+}
+
+func logSumExp(x, y float64) float64 {
+	if math.IsInf(x, -1) {
+		return y
+	}
+	if math.IsInf(y, -1) {
+		return x
+	}
+	if x < y {
+		x, y = y, x
+	}
+	return x + math.Log1p(math.Exp(y-x))
+}
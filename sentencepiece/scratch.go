@@ -0,0 +1,45 @@
+package sentencepiece
+
+// Scratch holds the buffers used to encode text, so that they can be reused
+// across calls. The zero value is ready to use. A Scratch must not be used by
+// several goroutines at the same time.
+type Scratch struct {
+	runes   []rune
+	offsets []int
+	symbols []slice
+	matches []trieNodeMeta
+	scores  []float32
+	slices  []slice
+	best    []slice
+	around  []slice
+	bytes   []slice
+}
+
+func (sc *Scratch) initScores(size int) []float32 {
+	if cap(sc.scores) < size {
+		sc.scores = make([]float32, size)
+	}
+	scores := sc.scores[:size]
+	for i := range scores {
+		scores[i] = minScore
+	}
+	return scores
+}
+
+func (sc *Scratch) initSlices(size int, unknown int32) []slice {
+	if cap(sc.slices) < size {
+		sc.slices = make([]slice, size)
+	}
+	slices := sc.slices[:size]
+	for i := range slices {
+		slices[i] = slice{index: unknown, start: -1}
+	}
+	return slices
+}
+
+func (sc *Scratch) bestSlices(size int) []slice {
+	if cap(sc.best) < size {
+		sc.best = make([]slice, size)
+	}
+	return sc.best[:size]
+}
@@ -1,15 +1,11 @@
 package sentencepiece
 
-import (
-	"fmt"
-	"math"
-	"unicode"
-	"unicode/utf8"
-)
+import "math"
 
 const minScore float32 = -math.MaxFloat32
 const sep rune = 0x2581
 const unknown string = "<unk>"
+const defaultUnknownSurface string = " \u2047 "
 
 type slice struct {
 	score float32
@@ -18,13 +14,10 @@ type slice struct {
 	end   int
 }
 
-type trieNode struct {
-	text     string
-	level    int
-	score    float32
-	index    int32
-	end      bool
-	children map[rune]trieNode
+type vocabPiece struct {
+	text  string
+	score float32
+	typ   ModelProto_SentencePiece_Type
 }
 
 type trieNodeMeta struct {
@@ -33,32 +26,50 @@ type trieNodeMeta struct {
 	index int32
 }
 
-func newTrieNode(text string, level int) trieNode {
-	return trieNode{
-		text:     text,
-		level:    level,
-		score:    0.0,
-		index:    0,
-		end:      false,
-		children: make(map[rune]trieNode),
-	}
-}
-
 // Sentencepiece holds the model
 type Sentencepiece struct {
-	root         trieNode
-	lowercase    bool
-	unknown      int32
-	controlWords map[string]int32
+	trie                   *doubleArray
+	lowercase              bool
+	addDummyPrefix         bool
+	removeExtraWhitespaces bool
+	escapeWhitespaces      bool
+	modelType              TrainerSpec_ModelType
+	byteFallback           bool
+	minPieceScore          float32
+	unknown                int32
+	bos                    int32
+	eos                    int32
+	pad                    int32
+	unknownSurface         string
+	charsmap               *charsmap
+	controlWords           map[string]int32
+	pieces                 []vocabPiece
+	pieceIDs               map[string]int32
+	bytePieces             []int32
+	matchUserDefined       bool
+	parsedControlWords     []string
+	symbols                map[string]int32
+	maxSymbolLength        int
+	offsetsMode            OffsetsMode
+	spec                   *ModelProto
 }
 
 // NewEmptySentencepiece creates an empty sentencepiece model
 func NewEmptySentencepiece(lowercase bool) Sentencepiece {
 	return Sentencepiece{
-		root:         newTrieNode("", 0),
-		lowercase:    lowercase,
-		unknown:      0,
-		controlWords: make(map[string]int32),
+		lowercase:              lowercase,
+		addDummyPrefix:         Default_NormalizerSpec_AddDummyPrefix,
+		removeExtraWhitespaces: Default_NormalizerSpec_RemoveExtraWhitespaces,
+		escapeWhitespaces:      Default_NormalizerSpec_EscapeWhitespaces,
+		modelType:              TrainerSpec_UNIGRAM,
+		minPieceScore:          math.MaxFloat32,
+		unknown:                0,
+		bos:                    -1,
+		eos:                    -1,
+		pad:                    -1,
+		unknownSurface:         defaultUnknownSurface,
+		controlWords:           make(map[string]int32),
+		pieceIDs:               make(map[string]int32),
 	}
 }
 
@@ -83,11 +94,46 @@ func (s *Sentencepiece) GetControlWord(word string) (int32, bool) {
 	return v, ok
 }
 
+func (s *Sentencepiece) addPiece(word string, score float32, typ ModelProto_SentencePiece_Type) int32 {
+	index := int32(len(s.pieces))
+	s.pieces = append(s.pieces, vocabPiece{text: word, score: score, typ: typ})
+	if _, ok := s.pieceIDs[word]; !ok {
+		s.pieceIDs[word] = index
+	}
+	return index
+}
+
+// lookupPiece returns the index of word if it is a piece which can be
+// produced by the encoders.
+func (s *Sentencepiece) lookupPiece(word string) (int32, bool) {
+	index, ok := s.pieceIDs[word]
+	if !ok {
+		return 0, false
+	}
+	switch s.pieces[index].typ {
+	case ModelProto_SentencePiece_NORMAL, ModelProto_SentencePiece_USER_DEFINED:
+		return index, true
+	}
+	return 0, false
+}
+
+// lookupMergePiece returns the index of word if it is a piece which BPE can
+// merge into, which includes the unused pieces.
+func (s *Sentencepiece) lookupMergePiece(word string) (int32, bool) {
+	if index, ok := s.lookupPiece(word); ok {
+		return index, true
+	}
+	index, ok := s.pieceIDs[word]
+	if !ok || s.pieces[index].typ != ModelProto_SentencePiece_UNUSED {
+		return 0, false
+	}
+	return index, true
+}
+
 // Tokenize tokenizes text into pieces
 func (s *Sentencepiece) Tokenize(text string) []Token {
-	runes := s.prepareFortokenize(text)
-	tokenOffsets := s.tokenizeToOffsets(runes, false)
-	return makeTokens(tokenOffsets, runes)
+	tokenOffsets := s.TokenizeToOffsets(text)
+	return makeTokens(tokenOffsets)
 }
 
 // TokenizeToIDs tokenizes text into ids from the vocab
@@ -100,79 +146,118 @@ func (s *Sentencepiece) TokenizeToIDs(text string) []int32 {
 	return ids
 }
 
+// TokenizeToOffsets tokenizes text into pieces along with their offsets in text,
+// in runes unless another unit is set with SetOffsetsMode
 func (s *Sentencepiece) TokenizeToOffsets(text string) []TokenOffset {
-	runes := s.prepareFortokenize(text)
-	padding := len(runes) - len([]rune(text))
-	return s.tokenizeToOffsets(runes, padding > 0)
+	return s.tokenizeWith(text, &Scratch{})
 }
 
-func (s *Sentencepiece) tokenizeToOffsets(runes []rune, adjustFirstPadding bool) []TokenOffset {
-	slices := s.decodeForwardToken(runes)
-	slices = s.decodeBackwards(slices)
-	return s.sliceToTokens(slices, runes, adjustFirstPadding)
+// EncodeIDsInto appends the ids of the pieces of text to dst and returns the
+// extended slice. The buffers of scratch are reused across calls, so that
+// unigram models encode without allocating once they have grown, when dst has
+// enough capacity. A nil scratch allocates new buffers.
+func (s *Sentencepiece) EncodeIDsInto(dst []int32, text string, scratch *Scratch) []int32 {
+	if scratch == nil {
+		scratch = &Scratch{}
+	}
+	_, _, slices := s.segment(text, func(runes []rune) []slice {
+		return s.encodeRunes(runes, scratch)
+	}, scratch)
+	for _, slice := range slices {
+		dst = append(dst, slice.index)
+	}
+	return dst
 }
 
-func (s *Sentencepiece) prepareFortokenize(text string) []rune {
-	runes := make([]rune, 0, len(text)+1)
-	first, _ := utf8.DecodeRuneInString(text)
-	if first != sep {
-		runes = append(runes, sep)
-	}
+func (s *Sentencepiece) tokenizeWith(text string, sc *Scratch) []TokenOffset {
+	return s.encodeTextWith(text, func(runes []rune) []slice {
+		return s.encodeRunes(runes, sc)
+	}, sc)
+}
 
-	for _, r := range text {
-		if isControl(r) || r == 0 {
-			runes = append(runes, ' ')
-		} else if unicode.IsSpace(r) {
-			runes = append(runes, sep)
-		} else if s.lowercase {
-			runes = append(runes, unicode.ToLower(r))
-		} else {
-			runes = append(runes, r)
-		}
+// encodeText normalizes text, segments it with encode and returns the tokens
+// along with their offsets in text.
+func (s *Sentencepiece) encodeText(text string, encode func(runes []rune) []slice) []TokenOffset {
+	return s.encodeTextWith(text, encode, &Scratch{})
+}
+
+func (s *Sentencepiece) encodeTextWith(text string, encode func(runes []rune) []slice, sc *Scratch) []TokenOffset {
+	runes, offsets, slices := s.segment(text, encode, sc)
+	s.convertOffsets(text, offsets)
+	return s.sliceToTokens(slices, runes, offsets)
+}
+
+// segment normalizes text into the buffers of sc and segments it with encode,
+// returning the normalized runes, their byte offsets in text and the slices.
+func (s *Sentencepiece) segment(text string, encode func(runes []rune) []slice, sc *Scratch) ([]rune, []int, []slice) {
+	runes, offsets, symbols := s.normalizeInto(text, sc)
+	return runes, offsets, s.segmentRunes(runes, symbols, encode, sc)
+}
+
+// segmentRunes segments normalized runes around the symbols with encode
+func (s *Sentencepiece) segmentRunes(runes []rune, symbols []slice, encode func(runes []rune) []slice, sc *Scratch) []slice {
+	var slices []slice
+	if len(symbols) == 0 {
+		slices = encode(runes)
+	} else {
+		sc.around = encodeAroundSymbols(sc.around[:0], runes, symbols, encode)
+		slices = sc.around
 	}
+	return s.resolveUnknowns(slices, runes, sc)
+}
 
-	return runes
+// encodeRunes segments runes with the encoder of the model type, reusing the
+// buffers of sc when it is not nil.
+func (s *Sentencepiece) encodeRunes(runes []rune, sc *Scratch) []slice {
+	switch s.modelType {
+	case TrainerSpec_BPE:
+		return s.encodeBPE(runes, 0, nil)
+	case TrainerSpec_WORD:
+		return s.encodeWords(runes)
+	case TrainerSpec_CHAR:
+		return s.encodeChars(runes)
+	default:
+		slices := s.decodeForwardToken(runes, sc)
+		return s.decodeBackwards(slices, sc)
+	}
 }
 
-func (s *Sentencepiece) insert(word string, score float32, index int32) {
-	_, size := utf8.DecodeLastRuneInString(word)
-	charCount := len(word)
-	node := &s.root
-	for i, r := range word {
-		text := node.text
-		cnode, ok := node.children[r]
-		if !ok {
-			newText := addChar(text, r)
-			cnode = newTrieNode(newText, node.level+1)
-		}
-		if i == charCount-size {
-			cnode.end = true
-			cnode.score = score
-			cnode.index = index
+// resolveUnknowns replaces unknown slices with byte pieces when the model has
+// byte fallback, and otherwise merges runs of them produced by the unigram
+// lattice. The byte pieces are written to the buffer of sc when it is not nil.
+func (s *Sentencepiece) resolveUnknowns(slices []slice, runes []rune, sc *Scratch) []slice {
+	if s.byteFallback {
+		if sc == nil {
+			return s.fallbackToBytes(nil, slices, runes)
 		}
-		node.children[r] = cnode
-		node = &cnode
+		sc.bytes = s.fallbackToBytes(sc.bytes[:0], slices, runes)
+		return sc.bytes
 	}
+	if s.modelType == TrainerSpec_UNIGRAM {
+		return s.mergeUnknowns(slices)
+	}
+	return slices
 }
 
-func (s *Sentencepiece) commonPrefixSearch(runes []rune) []trieNodeMeta {
-	var output []trieNodeMeta
-	node := s.root
-	for _, r := range runes {
-		cnode, ok := node.children[r]
-		if !ok {
-			break
-		}
-		if cnode.end {
-			output = append(output, trieNodeMeta{cnode.level, cnode.score, cnode.index})
+// buildTrie builds the trie matching the pieces of entries
+func (s *Sentencepiece) buildTrie(entries []trieEntry) {
+	for _, entry := range entries {
+		if entry.score < s.minPieceScore {
+			s.minPieceScore = entry.score
 		}
-		node = cnode
 	}
-	return output
+	s.trie = newDoubleArray(entries)
+}
+
+func (s *Sentencepiece) commonPrefixSearch(runes []rune) []trieNodeMeta {
+	return s.trie.commonPrefixSearch(nil, runes)
 }
 
-func (s *Sentencepiece) decodeBackwards(slices []slice) []slice {
-	best := make([]slice, len(slices))
+func (s *Sentencepiece) decodeBackwards(slices []slice, sc *Scratch) []slice {
+	if sc == nil {
+		sc = &Scratch{}
+	}
+	best := sc.bestSlices(len(slices))
 	len := len(slices) - 1
 	i := len
 	index := len
@@ -188,47 +273,60 @@ func (s *Sentencepiece) decodeBackwards(slices []slice) []slice {
 	return best[i : len+1]
 }
 
-func (s *Sentencepiece) decodeForwardToken(runes []rune) []slice {
-	scores := initScores(len(runes) + 1)
-	slices := s.initSlices(len(runes) + 1)
+func (s *Sentencepiece) decodeForwardToken(runes []rune, sc *Scratch) []slice {
+	if sc == nil {
+		sc = &Scratch{}
+	}
+	scores := sc.initScores(len(runes) + 1)
+	slices := sc.initSlices(len(runes)+1, s.unknown)
 	scores[0] = 0.0
+	unknownScore := s.minPieceScore - unknownPenalty
 	for i := range runes {
-		matches := s.commonPrefixSearch(runes[i:])
-		for _, node := range matches {
+		hasSingleRune := false
+		sc.matches = s.trie.commonPrefixSearch(sc.matches[:0], runes[i:])
+		for _, node := range sc.matches {
 			localScore := scores[i] + node.score
 			charEnd := i + node.level
 			if localScore > scores[charEnd] {
 				slices[charEnd] = slice{score: localScore, index: node.index, start: i, end: charEnd}
 				scores[charEnd] = localScore
 			}
+			hasSingleRune = hasSingleRune || node.level == 1
 		}
-		if scores[i+1] <= minScore {
-			slices[i+1] = slice{score: minScore, index: s.unknown, start: i, end: i + 1}
-			scores[i+1] = 0.0
+		if !hasSingleRune {
+			// Score unknown runes like the lattice and the C++ model do, so
+			// that a longer piece over them can win.
+			if localScore := scores[i] + unknownScore; localScore > scores[i+1] {
+				slices[i+1] = slice{score: localScore, index: s.unknown, start: i, end: i + 1}
+				scores[i+1] = localScore
+			}
 		}
 	}
 	return slices
 }
 
-func (s *Sentencepiece) sliceToTokens(slices []slice, runes []rune, adjustFirstPadding bool) []TokenOffset {
+// mergeUnknowns merges runs of consecutive unknown slices into a single
+// unknown slice spanning all of them, like the C++ unigram model.
+func (s *Sentencepiece) mergeUnknowns(slices []slice) []slice {
+	output := slices[:0]
+	for _, slice := range slices {
+		if n := len(output); n > 0 && slice.index == s.unknown && output[n-1].index == s.unknown {
+			output[n-1].end = slice.end
+			continue
+		}
+		output = append(output, slice)
+	}
+	return output
+}
+
+func (s *Sentencepiece) sliceToTokens(slices []slice, runes []rune, offsets []int) []TokenOffset {
 	tokens := make([]TokenOffset, 0, len(slices)+1)
-	isPrevUnknown := false
 	for _, slice := range slices {
-		if !isPrevUnknown || slice.index != s.unknown {
-			word := string(runes[slice.start:slice.end])
-			start := slice.start
-			end := slice.end
-			if adjustFirstPadding {
-				if start > 0 {
-					start -= 1
-				}
-				end--
-			}
-			if end > 0 {
-				tokens = append(tokens, TokenOffset{ID: slice.index, Text: word, Start: start, End: end})
-			}
+		word := string(runes[slice.start:slice.end])
+		if s.isByteID(slice.index) {
+			word = s.pieces[slice.index].text
 		}
-		isPrevUnknown = slice.index == s.unknown
+		tokens = append(tokens, TokenOffset{ID: slice.index, Text: word, Start: offsets[slice.start], End: offsets[slice.end]})
 	}
 	return tokens
 }
@@ -241,16 +339,7 @@ func initScores(len int) []float32 {
 	return scores
 }
 
-func (s *Sentencepiece) initSlices(len int) []slice {
-	slices := make([]slice, len)
-	for i := range slices {
-		slices[i].start = -1
-		slices[i].index = s.unknown
-	}
-	return slices
-}
-
-func makeTokens(offsets []TokenOffset, runes []rune) []Token {
+func makeTokens(offsets []TokenOffset) []Token {
 	tokens := make([]Token, len(offsets))
 	for i, offset := range offsets {
 		tokens[i] = Token{ID: offset.ID, Text: offset.Text}
@@ -258,10 +347,6 @@ func makeTokens(offsets []TokenOffset, runes []rune) []Token {
 	return tokens
 }
 
-func addChar(s string, r rune) string {
-	return fmt.Sprintf("%s%c", s, r)
-}
-
 func isControl(c rune) bool {
 	if c == ' ' || c == '\n' || c == '\r' || c == '\t' {
 		return false
@@ -1,7 +1,10 @@
 package sentencepiece
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
 
 	"google.golang.org/protobuf/proto"
@@ -9,31 +12,171 @@ import (
 
 // NewSentencepieceFromFile creates sentencepiece from file.
 func NewSentencepieceFromFile(filename string, lowercase bool) (Sentencepiece, error) {
-	s := NewEmptySentencepiece(lowercase)
 	bytes, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return s, fmt.Errorf("Unable to read file : %s, err %v", filename, err)
+		return NewEmptySentencepiece(lowercase), fmt.Errorf("Unable to read file : %s, err %v", filename, err)
 	}
-	var model ModelProto
-	err = proto.Unmarshal(bytes, &model)
+	s, err := NewSentencepieceFromBytes(bytes, lowercase)
 	if err != nil {
 		return s, fmt.Errorf("Unable to read model file : %s, err %v", filename, err)
 	}
+	return s, nil
+}
+
+// NewSentencepieceFromFS creates sentencepiece from a file of the file system.
+func NewSentencepieceFromFS(fsys fs.FS, name string, lowercase bool) (Sentencepiece, error) {
+	bytes, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return NewEmptySentencepiece(lowercase), fmt.Errorf("Unable to read file : %s, err %v", name, err)
+	}
+	s, err := NewSentencepieceFromBytes(bytes, lowercase)
+	if err != nil {
+		return s, fmt.Errorf("Unable to read model file : %s, err %v", name, err)
+	}
+	return s, nil
+}
+
+// NewSentencepieceFromReader creates sentencepiece from the serialized model read from r.
+func NewSentencepieceFromReader(r io.Reader, lowercase bool) (Sentencepiece, error) {
+	bytes, err := ioutil.ReadAll(r)
+	if err != nil {
+		return NewEmptySentencepiece(lowercase), fmt.Errorf("Unable to read model, err %v", err)
+	}
+	return NewSentencepieceFromBytes(bytes, lowercase)
+}
+
+// NewSentencepieceFromBytes creates sentencepiece from a serialized model.
+func NewSentencepieceFromBytes(bytes []byte, lowercase bool) (Sentencepiece, error) {
+	var model ModelProto
+	err := proto.Unmarshal(bytes, &model)
+	if err != nil {
+		return NewEmptySentencepiece(lowercase), fmt.Errorf("Unable to parse model, err %v", err)
+	}
+	return NewSentencepieceFromModel(&model, lowercase)
+}
 
+// NewSentencepieceFromModel creates sentencepiece from a model.
+func NewSentencepieceFromModel(model *ModelProto, lowercase bool) (Sentencepiece, error) {
+	s := NewEmptySentencepiece(lowercase)
+	var err error
+	trainerSpec := model.GetTrainerSpec()
+	normalizerSpec := model.GetNormalizerSpec()
+	s.addDummyPrefix = normalizerSpec.GetAddDummyPrefix()
+	s.removeExtraWhitespaces = normalizerSpec.GetRemoveExtraWhitespaces()
+	s.escapeWhitespaces = normalizerSpec.GetEscapeWhitespaces()
+	s.modelType = trainerSpec.GetModelType()
+	s.byteFallback = trainerSpec.GetByteFallback()
+	s.unknownSurface = trainerSpec.GetUnkSurface()
+	s.charsmap, err = newCharsmap(normalizerSpec.GetPrecompiledCharsmap())
+	if err != nil {
+		return s, fmt.Errorf("Unable to read normalizer, err %v", err)
+	}
+
+	var entries []trieEntry
 	count := 0
 	for i, piece := range model.GetPieces() {
 		typ := piece.GetType()
 		word := piece.GetPiece()
+		s.addPiece(word, piece.GetScore(), typ)
 		switch typ {
 		case ModelProto_SentencePiece_NORMAL, ModelProto_SentencePiece_USER_DEFINED:
-			s.insert(word, piece.GetScore(), int32(i))
+			entries = append(entries, trieEntry{key: word, score: piece.GetScore(), index: int32(i)})
 		case ModelProto_SentencePiece_UNKNOWN:
 			s.SetUnknownIndex(int32(i))
 		case ModelProto_SentencePiece_CONTROL:
 			s.SetControlWord(word, int32(i))
+		case ModelProto_SentencePiece_BYTE:
+			if b, ok := parseBytePiece(word); ok {
+				s.setBytePiece(b, int32(i))
+			}
 		}
 		count++
 	}
+	s.buildTrie(entries)
+
+	s.bos = s.specialIndex(trainerSpec.GetBosId(), trainerSpec.GetBosPiece())
+	s.eos = s.specialIndex(trainerSpec.GetEosId(), trainerSpec.GetEosPiece())
+	s.pad = s.specialIndex(trainerSpec.GetPadId(), trainerSpec.GetPadPiece())
+	s.spec = proto.Clone(&ModelProto{
+		TrainerSpec:      model.TrainerSpec,
+		NormalizerSpec:   model.NormalizerSpec,
+		SelfTestData:     model.SelfTestData,
+		DenormalizerSpec: model.DenormalizerSpec,
+	}).(*ModelProto)
 
 	return s, nil
 }
+
+// ModelProto returns the pieces of the model along with the specs it was
+// loaded with, updated with the settings of the model.
+func (s *Sentencepiece) ModelProto() *ModelProto {
+	model := &ModelProto{}
+	if s.spec != nil {
+		model = proto.Clone(s.spec).(*ModelProto)
+	}
+	if model.TrainerSpec == nil {
+		model.TrainerSpec = &TrainerSpec{}
+	}
+	if model.NormalizerSpec == nil {
+		model.NormalizerSpec = &NormalizerSpec{}
+	}
+
+	trainerSpec := model.TrainerSpec
+	if trainerSpec.GetModelType() != s.modelType {
+		trainerSpec.ModelType = s.modelType.Enum()
+	}
+	if trainerSpec.GetByteFallback() != s.byteFallback {
+		trainerSpec.ByteFallback = proto.Bool(s.byteFallback)
+	}
+	if trainerSpec.GetUnkSurface() != s.unknownSurface {
+		trainerSpec.UnkSurface = proto.String(s.unknownSurface)
+	}
+	normalizerSpec := model.NormalizerSpec
+	if normalizerSpec.GetAddDummyPrefix() != s.addDummyPrefix {
+		normalizerSpec.AddDummyPrefix = proto.Bool(s.addDummyPrefix)
+	}
+	if normalizerSpec.GetRemoveExtraWhitespaces() != s.removeExtraWhitespaces {
+		normalizerSpec.RemoveExtraWhitespaces = proto.Bool(s.removeExtraWhitespaces)
+	}
+	if normalizerSpec.GetEscapeWhitespaces() != s.escapeWhitespaces {
+		normalizerSpec.EscapeWhitespaces = proto.Bool(s.escapeWhitespaces)
+	}
+
+	model.Pieces = make([]*ModelProto_SentencePiece, len(s.pieces))
+	for i, piece := range s.pieces {
+		// Like spm_train, the type is only set for pieces which are not normal.
+		model.Pieces[i] = &ModelProto_SentencePiece{
+			Piece: proto.String(piece.text),
+			Score: proto.Float32(piece.score),
+		}
+		if piece.typ != ModelProto_SentencePiece_NORMAL {
+			model.Pieces[i].Type = piece.typ.Enum()
+		}
+	}
+	return model
+}
+
+// WriteTo writes the model to w in the .model protobuf format
+func (s *Sentencepiece) WriteTo(w io.Writer) (int64, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(s.ModelProto())
+	if err != nil {
+		return 0, fmt.Errorf("Unable to marshal model, err %v", err)
+	}
+	n, err := w.Write(data)
+	if err != nil {
+		return int64(n), fmt.Errorf("Unable to write model, err %v", err)
+	}
+	return int64(n), nil
+}
+
+// SaveModel writes the model to a .model file
+func (s *Sentencepiece) SaveModel(filename string) error {
+	var buf bytes.Buffer
+	if _, err := s.WriteTo(&buf); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("Unable to write model file : %s, err %v", filename, err)
+	}
+	return nil
+}
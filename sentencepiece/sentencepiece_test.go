@@ -1,8 +1,18 @@
 package sentencepiece
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
 	"reflect"
+	"runtime"
 	"testing"
+
+	"google.golang.org/protobuf/proto"
 )
 
 func TestTokenization(t *testing.T) {
@@ -27,8 +37,8 @@ func TestTokenization(t *testing.T) {
 			{ID: 22, Text: "▁to"},
 			{ID: 39, Text: "▁be"},
 			{ID: 22, Text: "▁to"},
-			{ID: 1235, Text: "ke"},
-			{ID: 0, Text: "́"},
+			{ID: 267, Text: "k"},
+			{ID: 0, Text: "é"},
 			{ID: 180, Text: "n"},
 			{ID: 1227, Text: "ized"},
 		}},
@@ -59,7 +69,7 @@ func TestTokenization(t *testing.T) {
 			{ID: 17, Text: "▁"},
 			{ID: 0, Text: "Ϻ"},
 			{ID: 17, Text: "▁"},
-			{ID: 0, Text: "Š"},
+			{ID: 0, Text: "Šœ"},
 			{ID: 128, Text: "▁U"},
 			{ID: 15222, Text: "gl"},
 			{ID: 1315, Text: "j"},
@@ -195,8 +205,8 @@ func TestTokenizationSPM(t *testing.T) {
 			{ID: 20, Text: "▁to"},
 			{ID: 44, Text: "▁be"},
 			{ID: 20, Text: "▁to"},
-			{ID: 1048, Text: "ke"},
-			{ID: 1, Text: "́"},
+			{ID: 197, Text: "k"},
+			{ID: 1, Text: "é"},
 			{ID: 103, Text: "n"},
 			{ID: 1333, Text: "ized"},
 		}},
@@ -390,7 +400,1313 @@ func testTokenOffset(t *testing.T, spm Sentencepiece, text string) {
 
 }
 
+func TestPrecompiledCharsmap(t *testing.T) {
+	sp, err := NewSentencepieceFromFile("test_data/spm.model", false)
+	if err != nil {
+		t.Errorf("Unable to create sentencepiece")
+		return
+	}
+
+	tests := []struct {
+		text       string
+		normalized string
+	}{
+		{text: "ｈｅｌｌｏ", normalized: "hello"},
+		{text: "ﬁne", normalized: "fine"},
+		{text: "①②", normalized: "12"},
+		{text: "x\u0001y", normalized: "xy"},
+		{text: "tokénized", normalized: "tokénized"},
+	}
+	for _, test := range tests {
+		output := sp.TokenizeToIDs(test.text)
+		expected := sp.TokenizeToIDs(test.normalized)
+		if !reflect.DeepEqual(output, expected) {
+			t.Errorf("Normalization error : %s, got %v || expected %v", test.text, output, expected)
+		}
+	}
+}
+
+func TestNormalizerSpec(t *testing.T) {
+	sp, err := NewSentencepieceFromFile("test_data/spm.model", true)
+	if err != nil {
+		t.Errorf("Unable to create sentencepiece")
+		return
+	}
+
+	text := "  Hello   world  "
+	expected := []TokenOffset{
+		{ID: 10975, Text: "▁hello", Start: 2, End: 7},
+		{ID: 126, Text: "▁world", Start: 7, End: 15},
+	}
+	output := sp.TokenizeToOffsets(text)
+	if !reflect.DeepEqual(output, expected) {
+		t.Errorf("Tokenization error : %q, got %v || expected %v", text, output, expected)
+	}
+	if len(sp.TokenizeToIDs("   ")) != 0 {
+		t.Errorf("Expected no tokens for whitespace only text")
+	}
+
+	tests := []struct {
+		modify     func(spec *NormalizerSpec)
+		text       string
+		normalized string
+		decoded    string
+	}{
+		{
+			modify:     func(spec *NormalizerSpec) { spec.AddDummyPrefix = proto.Bool(false) },
+			text:       " hello world ",
+			normalized: "hello▁world",
+			decoded:    "hello world",
+		},
+		{
+			modify:     func(spec *NormalizerSpec) { spec.RemoveExtraWhitespaces = proto.Bool(false) },
+			text:       " hello  world ",
+			normalized: "▁▁hello▁▁world▁",
+			decoded:    " hello  world ",
+		},
+		{
+			modify:     func(spec *NormalizerSpec) { spec.EscapeWhitespaces = proto.Bool(false) },
+			text:       "hello  world",
+			normalized: " hello world",
+		},
+	}
+	for _, test := range tests {
+		sp := loadModifiedModel(t, "test_data/spm.model", func(model *ModelProto) {
+			test.modify(model.NormalizerSpec)
+		})
+		normalized := string(sp.prepareFortokenize(test.text))
+		if normalized != test.normalized {
+			t.Errorf("Normalization error : %q, got %q || expected %q", test.text, normalized, test.normalized)
+		}
+		if test.decoded == "" {
+			continue
+		}
+		decoded, err := sp.DecodeIDs(sp.TokenizeToIDs(test.text))
+		if err != nil || decoded != test.decoded {
+			t.Errorf("Decode error : %q, got %q || expected %q", test.text, decoded, test.decoded)
+		}
+	}
+}
+
+func loadModifiedModel(t *testing.T, filename string, modify func(model *ModelProto)) Sentencepiece {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Unable to read model : %v", err)
+	}
+	var model ModelProto
+	if err := proto.Unmarshal(bytes, &model); err != nil {
+		t.Fatalf("Unable to parse model : %v", err)
+	}
+	modify(&model)
+	return loadModel(t, &model)
+}
+
+func loadByteFallbackModel(t *testing.T) Sentencepiece {
+	return loadModifiedModel(t, "test_data/xlnet-base-cased-spiece.model", func(model *ModelProto) {
+		model.TrainerSpec.ByteFallback = proto.Bool(true)
+		for i := 0; i < 256; i++ {
+			model.Pieces = append(model.Pieces, &ModelProto_SentencePiece{
+				Piece: proto.String(fmt.Sprintf("<0x%02X>", i)),
+				Score: proto.Float32(0),
+				Type:  ModelProto_SentencePiece_BYTE.Enum(),
+			})
+		}
+	})
+}
+
+func loadModel(t *testing.T, model *ModelProto) Sentencepiece {
+	sp, err := NewSentencepieceFromModel(model, false)
+	if err != nil {
+		t.Fatalf("Unable to create sentencepiece : %v", err)
+	}
+	return sp
+}
+
+type testPiece struct {
+	piece string
+	score float32
+	typ   ModelProto_SentencePiece_Type
+}
+
+func newTestModel(modelType TrainerSpec_ModelType, pieces []testPiece) *ModelProto {
+	model := &ModelProto{
+		TrainerSpec:    &TrainerSpec{ModelType: modelType.Enum()},
+		NormalizerSpec: &NormalizerSpec{},
+	}
+	for _, piece := range pieces {
+		typ := piece.typ
+		if typ == 0 {
+			typ = ModelProto_SentencePiece_NORMAL
+		}
+		model.Pieces = append(model.Pieces, &ModelProto_SentencePiece{
+			Piece: proto.String(piece.piece),
+			Score: proto.Float32(piece.score),
+			Type:  typ.Enum(),
+		})
+	}
+	return model
+}
+
+func newTestBPEModel() *ModelProto {
+	return newTestModel(TrainerSpec_BPE, []testPiece{
+		{piece: "<unk>", typ: ModelProto_SentencePiece_UNKNOWN},
+		{piece: "<s>", typ: ModelProto_SentencePiece_CONTROL},
+		{piece: "</s>", typ: ModelProto_SentencePiece_CONTROL},
+		{piece: "el", score: -1},
+		{piece: "he", score: -2},
+		{piece: "lo", score: -3},
+		{piece: "▁h", score: -4},
+		{piece: "▁hel", score: -5},
+		{piece: "▁hello", score: -6},
+		{piece: "or", score: -7},
+		{piece: "▁w", score: -8},
+		{piece: "▁wor", score: -9},
+		{piece: "ld", score: -10},
+		{piece: "▁", score: -11},
+		{piece: "h", score: -12},
+		{piece: "e", score: -13},
+		{piece: "l", score: -14},
+		{piece: "o", score: -15},
+		{piece: "w", score: -16},
+		{piece: "r", score: -17},
+		{piece: "d", score: -18},
+	})
+}
+
+func TestTokenizationBPE(t *testing.T) {
+	sp := loadModel(t, newTestBPEModel())
+
+	tests := []struct {
+		text   string
+		tokens []Token
+	}{
+		{text: "hello", tokens: []Token{{ID: 8, Text: "▁hello"}}},
+		{text: "hello world", tokens: []Token{
+			{ID: 8, Text: "▁hello"},
+			{ID: 11, Text: "▁wor"},
+			{ID: 12, Text: "ld"},
+		}},
+		{text: "held", tokens: []Token{
+			{ID: 7, Text: "▁hel"},
+			{ID: 20, Text: "d"},
+		}},
+		{text: "oz", tokens: []Token{
+			{ID: 13, Text: "▁"},
+			{ID: 17, Text: "o"},
+			{ID: 0, Text: "z"},
+		}},
+	}
+
+	for _, test := range tests {
+		output := sp.Tokenize(test.text)
+		if !reflect.DeepEqual(output, test.tokens) {
+			t.Errorf("Tokenization error : %s, got %v || expected %v", test.text, output, test.tokens)
+		}
+	}
+
+	model := newTestBPEModel()
+	model.Pieces[7].Type = ModelProto_SentencePiece_UNUSED.Enum()
+	sp = loadModel(t, model)
+	output := sp.Tokenize("held")
+	expected := []Token{{ID: 6, Text: "▁h"}, {ID: 3, Text: "el"}, {ID: 20, Text: "d"}}
+	if !reflect.DeepEqual(output, expected) {
+		t.Errorf("Tokenization error : held, got %v || expected %v", output, expected)
+	}
+}
+
+func TestEncodeWithDropout(t *testing.T) {
+	sp := loadModel(t, newTestBPEModel())
+
+	text := "hello world"
+	best := sp.TokenizeToOffsets(text)
+	if output := sp.EncodeWithDropout(text, 0, rand.New(rand.NewSource(1))); !reflect.DeepEqual(output, best) {
+		t.Errorf("Expected no dropout with p 0, got %v || expected %v", output, best)
+	}
+	if output := sp.EncodeWithDropout(text, 1, nil); len(output) != len([]rune(sp.prepareFortokenize(text))) {
+		t.Errorf("Expected no merges with p 1, got %v", output)
+	}
+
+	segmentations := make(map[string]bool)
+	for seed := int64(0); seed < 50; seed++ {
+		first := sp.EncodeWithDropout(text, 0.3, rand.New(rand.NewSource(seed)))
+		second := sp.EncodeWithDropout(text, 0.3, rand.New(rand.NewSource(seed)))
+		if !reflect.DeepEqual(first, second) {
+			t.Errorf("Expected the same output with the same seed, got %v || %v", first, second)
+		}
+		var joined string
+		for _, token := range first {
+			joined += token.Text
+		}
+		if joined != "▁hello▁world" {
+			t.Errorf("Tokens %v do not cover the text", first)
+		}
+		segmentations[fmt.Sprint(first)] = true
+	}
+	if len(segmentations) < 5 {
+		t.Errorf("Expected various segmentations with dropout, got %d", len(segmentations))
+	}
+}
+
+func TestTokenizationWordAndChar(t *testing.T) {
+	pieces := []testPiece{
+		{piece: "<unk>", typ: ModelProto_SentencePiece_UNKNOWN},
+		{piece: "<s>", typ: ModelProto_SentencePiece_CONTROL},
+		{piece: "▁hello", score: -1},
+		{piece: "▁world", score: -2},
+		{piece: "▁", score: -3},
+		{piece: "h", score: -4},
+		{piece: "e", score: -5},
+		{piece: "l", score: -6},
+		{piece: "o", score: -7},
+	}
+
+	tests := []struct {
+		modelType TrainerSpec_ModelType
+		text      string
+		tokens    []TokenOffset
+	}{
+		{modelType: TrainerSpec_WORD, text: "hello world", tokens: []TokenOffset{
+			{ID: 2, Text: "▁hello", Start: 0, End: 5},
+			{ID: 3, Text: "▁world", Start: 5, End: 11},
+		}},
+		{modelType: TrainerSpec_WORD, text: "hello big  big world", tokens: []TokenOffset{
+			{ID: 2, Text: "▁hello", Start: 0, End: 5},
+			{ID: 0, Text: "▁big", Start: 5, End: 9},
+			{ID: 0, Text: "▁big", Start: 9, End: 14},
+			{ID: 3, Text: "▁world", Start: 14, End: 20},
+		}},
+		{modelType: TrainerSpec_CHAR, text: "hole", tokens: []TokenOffset{
+			{ID: 4, Text: "▁", Start: 0, End: 0},
+			{ID: 5, Text: "h", Start: 0, End: 1},
+			{ID: 8, Text: "o", Start: 1, End: 2},
+			{ID: 7, Text: "l", Start: 2, End: 3},
+			{ID: 6, Text: "e", Start: 3, End: 4},
+		}},
+		{modelType: TrainerSpec_CHAR, text: "hxy", tokens: []TokenOffset{
+			{ID: 4, Text: "▁", Start: 0, End: 0},
+			{ID: 5, Text: "h", Start: 0, End: 1},
+			{ID: 0, Text: "x", Start: 1, End: 2},
+			{ID: 0, Text: "y", Start: 2, End: 3},
+		}},
+	}
+
+	for _, test := range tests {
+		sp := loadModel(t, newTestModel(test.modelType, pieces))
+		output := sp.TokenizeToOffsets(test.text)
+		if !reflect.DeepEqual(output, test.tokens) {
+			t.Errorf("Tokenization error : %v %s, got %v || expected %v", test.modelType, test.text, output, test.tokens)
+		}
+	}
+}
+
+func TestByteFallback(t *testing.T) {
+	sp := loadByteFallbackModel(t)
+
+	text := "get 🤔 𩸽"
+	expected := []TokenOffset{
+		{ID: 133, Text: "▁get", Start: 0, End: 3},
+		{ID: 17, Text: "▁", Start: 3, End: 4},
+		{ID: 32000 + 0xF0, Text: "<0xF0>", Start: 4, End: 4},
+		{ID: 32000 + 0x9F, Text: "<0x9F>", Start: 4, End: 4},
+		{ID: 32000 + 0xA4, Text: "<0xA4>", Start: 4, End: 4},
+		{ID: 32000 + 0x94, Text: "<0x94>", Start: 4, End: 5},
+		{ID: 17, Text: "▁", Start: 5, End: 6},
+		{ID: 32000 + 0xF0, Text: "<0xF0>", Start: 6, End: 6},
+		{ID: 32000 + 0xA9, Text: "<0xA9>", Start: 6, End: 6},
+		{ID: 32000 + 0xB8, Text: "<0xB8>", Start: 6, End: 6},
+		{ID: 32000 + 0xBD, Text: "<0xBD>", Start: 6, End: 7},
+	}
+	output := sp.TokenizeToOffsets(text)
+	if !reflect.DeepEqual(output, expected) {
+		t.Errorf("Tokenization error : %s, got %v || expected %v", text, output, expected)
+	}
+
+	texts := []string{
+		text,
+		"Wondering how this will get tokenized 🤔 ?",
+		"İs th!s 𩸽 Ϻ Šœ Ugljšić dấu nặng",
+	}
+	for _, text := range texts {
+		output, err := sp.DecodeIDs(sp.TokenizeToIDs(text))
+		if err != nil || output != text {
+			t.Errorf("Decode error : %s, got %q, err %v", text, output, err)
+		}
+	}
+
+	decoded, _ := sp.DecodeIDs([]int32{133, 32000 + 0xF0, 32000 + 0x41})
+	if decoded != "get�A" {
+		t.Errorf("Decode error : got %q", decoded)
+	}
+}
+
+func TestSampleEncode(t *testing.T) {
+	sp, err := NewSentencepieceFromFile("test_data/spm.model", true)
+	if err != nil {
+		t.Errorf("Unable to create sentencepiece")
+		return
+	}
+
+	text := "Spiderman seems to be a good movie 𩸽"
+	normalized := string(sp.prepareFortokenize(text))
+	best := sp.TokenizeToOffsets(text)
+
+	rng := rand.New(rand.NewSource(1))
+	segmentations := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		output := sp.SampleEncode(text, 0.1, rng)
+		var joined, key string
+		for _, token := range output {
+			joined += token.Text
+			key += fmt.Sprintf("%d ", token.ID)
+		}
+		if joined != normalized {
+			t.Errorf("Sampled tokens %v do not cover %q", output, normalized)
+		}
+		segmentations[key] = true
+	}
+	if len(segmentations) < 10 {
+		t.Errorf("Expected various segmentations with a small alpha, got %d", len(segmentations))
+	}
+
+	for i := 0; i < 10; i++ {
+		output := sp.SampleEncode(text, 100, rng)
+		if !reflect.DeepEqual(output, best) {
+			t.Errorf("Expected best segmentation with a large alpha, got %v || expected %v", output, best)
+		}
+	}
+
+	first := sp.SampleEncode(text, 0.5, rand.New(rand.NewSource(7)))
+	second := sp.SampleEncode(text, 0.5, rand.New(rand.NewSource(7)))
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("Expected the same samples with the same seed, got %v || %v", first, second)
+	}
+}
+
+func TestNBestTokenize(t *testing.T) {
+	sp, err := NewSentencepieceFromFile("test_data/spm.model", true)
+	if err != nil {
+		t.Errorf("Unable to create sentencepiece")
+		return
+	}
+
+	text := "Spiderman seems good"
+	normalized := string(sp.prepareFortokenize(text))
+	nbest, scores := sp.NBestTokenize(text, 10)
+	if len(nbest) != 10 || len(scores) != 10 {
+		t.Errorf("Expected 10 segmentations, got %d", len(nbest))
+		return
+	}
+	if best := sp.TokenizeToOffsets(text); !reflect.DeepEqual(nbest[0], best) {
+		t.Errorf("Expected best segmentation first, got %v || expected %v", nbest[0], best)
+	}
+
+	segmentations := make(map[string]bool)
+	for i, output := range nbest {
+		var joined, key string
+		var score float32
+		for _, token := range output {
+			joined += token.Text
+			key += fmt.Sprintf("%d ", token.ID)
+			score += sp.pieces[token.ID].score
+		}
+		if joined != normalized {
+			t.Errorf("Segmentation %v does not cover %q", output, normalized)
+		}
+		if segmentations[key] {
+			t.Errorf("Duplicate segmentation %v", output)
+		}
+		segmentations[key] = true
+		if math.Abs(float64(score-scores[i])) > 1e-3 {
+			t.Errorf("Score of %v is %f, expected %f", output, scores[i], score)
+		}
+		if i > 0 && scores[i] > scores[i-1] {
+			t.Errorf("Scores not in decreasing order : %v", scores)
+		}
+	}
+
+	if nbest, _ := sp.NBestTokenize("", 3); len(nbest) != 1 || len(nbest[0]) != 0 {
+		t.Errorf("Expected a single empty segmentation for empty text, got %v", nbest)
+	}
+
+	sp = loadModel(t, newTestModel(TrainerSpec_UNIGRAM, []testPiece{
+		{piece: "<unk>", typ: ModelProto_SentencePiece_UNKNOWN},
+		{piece: "▁", score: -1},
+		{piece: "y", score: -2},
+		{piece: "z", score: -2},
+		{piece: "yz", score: -1},
+		{piece: "xyz", score: -6},
+	}))
+	expected := []TokenOffset{
+		{ID: 1, Text: "▁", Start: 0, End: 0},
+		{ID: 5, Text: "xyz", Start: 0, End: 3},
+	}
+	best := sp.TokenizeToOffsets("xyz")
+	if !reflect.DeepEqual(best, expected) {
+		t.Errorf("Tokenization error : xyz, got %v || expected %v", best, expected)
+	}
+	if nbest, _ := sp.NBestTokenize("xyz", 1); len(nbest) != 1 || !reflect.DeepEqual(nbest[0], best) {
+		t.Errorf("Expected best segmentation first, got %v || expected %v", nbest, best)
+	}
+}
+
+func TestLoaders(t *testing.T) {
+	filename := "test_data/xlnet-base-cased-spiece.model"
+	sp, err := NewSentencepieceFromFile(filename, false)
+	if err != nil {
+		t.Errorf("Unable to create sentencepiece")
+		return
+	}
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Errorf("Unable to read model : %v", err)
+		return
+	}
+	var model ModelProto
+	if err := proto.Unmarshal(bytes, &model); err != nil {
+		t.Errorf("Unable to parse model : %v", err)
+		return
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Errorf("Unable to open model : %v", err)
+		return
+	}
+	defer file.Close()
+
+	loaders := map[string]func() (Sentencepiece, error){
+		"bytes":  func() (Sentencepiece, error) { return NewSentencepieceFromBytes(bytes, false) },
+		"reader": func() (Sentencepiece, error) { return NewSentencepieceFromReader(file, false) },
+		"fs": func() (Sentencepiece, error) {
+			return NewSentencepieceFromFS(os.DirFS("test_data"), "xlnet-base-cased-spiece.model", false)
+		},
+		"model": func() (Sentencepiece, error) { return NewSentencepieceFromModel(&model, false) },
+	}
+	text := "Wondering how this will get tokenized 🤔 ?"
+	expected := sp.TokenizeToIDs(text)
+	for name, loader := range loaders {
+		loaded, err := loader()
+		if err != nil {
+			t.Errorf("Unable to create sentencepiece from %s : %v", name, err)
+			continue
+		}
+		if output := loaded.TokenizeToIDs(text); !reflect.DeepEqual(output, expected) {
+			t.Errorf("Tokenization error from %s : got %v || expected %v", name, output, expected)
+		}
+	}
+
+	if _, err := NewSentencepieceFromBytes([]byte("not a model"), false); err == nil {
+		t.Errorf("Expected error for invalid model")
+	}
+	if _, err := NewSentencepieceFromFS(os.DirFS("test_data"), "missing.model", false); err == nil {
+		t.Errorf("Expected error for missing file")
+	}
+}
+
+func TestEncodeOptions(t *testing.T) {
+	sp, err := NewSentencepieceFromFile("test_data/xlnet-base-cased-spiece.model", false)
+	if err != nil {
+		t.Errorf("Unable to create sentencepiece")
+		return
+	}
+
+	tests := []struct {
+		opts   EncodeOptions
+		tokens []TokenOffset
+	}{
+		{opts: EncodeOptions{}, tokens: []TokenOffset{
+			{ID: 52, Text: "▁this", Start: 0, End: 4},
+			{ID: 17, Text: "▁", Start: 4, End: 5},
+			{ID: 0, Text: "🤔", Start: 5, End: 6},
+		}},
+		{opts: EncodeOptions{AddBOS: true, AddEOS: true}, tokens: []TokenOffset{
+			{ID: 1, Text: "<s>", Start: 0, End: 0},
+			{ID: 52, Text: "▁this", Start: 0, End: 4},
+			{ID: 17, Text: "▁", Start: 4, End: 5},
+			{ID: 0, Text: "🤔", Start: 5, End: 6},
+			{ID: 2, Text: "</s>", Start: 6, End: 6},
+		}},
+		{opts: EncodeOptions{AddEOS: true, Reverse: true, UnknownPiece: true}, tokens: []TokenOffset{
+			{ID: 0, Text: "<unk>", Start: 5, End: 6},
+			{ID: 17, Text: "▁", Start: 4, End: 5},
+			{ID: 52, Text: "▁this", Start: 0, End: 4},
+			{ID: 2, Text: "</s>", Start: 6, End: 6},
+		}},
+	}
+	for _, test := range tests {
+		output := sp.Encode("this 🤔", test.opts)
+		if !reflect.DeepEqual(output, test.tokens) {
+			t.Errorf("Encode error : %+v, got %v || expected %v", test.opts, output, test.tokens)
+		}
+	}
+
+	extraTests := []struct {
+		options string
+		tokens  []TokenOffset
+	}{
+		{options: "bos:eos:reverse", tokens: []TokenOffset{
+			{ID: 2, Text: "</s>", Start: 6, End: 6},
+			{ID: 0, Text: "🤔", Start: 5, End: 6},
+			{ID: 17, Text: "▁", Start: 4, End: 5},
+			{ID: 52, Text: "▁this", Start: 0, End: 4},
+			{ID: 1, Text: "<s>", Start: 0, End: 0},
+		}},
+		{options: "reverse:bos:eos:unk", tokens: []TokenOffset{
+			{ID: 1, Text: "<s>", Start: 0, End: 0},
+			{ID: 0, Text: "<unk>", Start: 5, End: 6},
+			{ID: 17, Text: "▁", Start: 4, End: 5},
+			{ID: 52, Text: "▁this", Start: 0, End: 4},
+			{ID: 2, Text: "</s>", Start: 6, End: 6},
+		}},
+	}
+	for _, test := range extraTests {
+		options, err := ParseExtraOptions(test.options)
+		if err != nil {
+			t.Errorf("ParseExtraOptions error : %s, got err %v", test.options, err)
+			continue
+		}
+		output := sp.EncodeWithExtraOptions("this 🤔", options)
+		if !reflect.DeepEqual(output, test.tokens) {
+			t.Errorf("Encode error : %s, got %v || expected %v", test.options, output, test.tokens)
+		}
+	}
+	if _, err := ParseExtraOptions("bos:rev"); err == nil {
+		t.Errorf("Expected error for unknown extra option")
+	}
+
+	if pad, ok := sp.GetPadIndex(); !ok || pad != 5 {
+		t.Errorf("Pad index not correct : %d", pad)
+	}
+
+	spm, err := NewSentencepieceFromFile("test_data/spm.model", true)
+	if err != nil {
+		t.Errorf("Unable to create sentencepiece")
+		return
+	}
+	if _, ok := spm.GetBOSIndex(); ok {
+		t.Errorf("Expected no BOS piece")
+	}
+	if pad, ok := spm.GetPadIndex(); !ok || pad != 0 {
+		t.Errorf("Pad index not correct : %d", pad)
+	}
+	if output := spm.EncodeToIDs("this", EncodeOptions{AddBOS: true, AddEOS: true}); !reflect.DeepEqual(output, []int32{48}) {
+		t.Errorf("Encode error : got %v", output)
+	}
+}
+
+func TestSymbolMatching(t *testing.T) {
+	sp := loadModifiedModel(t, "test_data/xlnet-base-cased-spiece.model", func(model *ModelProto) {
+		model.Pieces[8].Score = proto.Float32(-100)
+	})
+
+	text := "Hello<eop>world <sep>"
+	tests := []struct {
+		matchUserDefined bool
+		controlWords     []string
+		ids              []int32
+	}{
+		{ids: []int32{17, 11368, 6461, 93, 1979, 3151, 5358, 7739, 23, 3882, 3151}},
+		{matchUserDefined: true, ids: []int32{17, 11368, 8, 5358, 7739, 23, 3882, 3151}},
+		{controlWords: []string{"<sep>", "<cls>"}, ids: []int32{17, 11368, 6461, 93, 1979, 3151, 5358, 17, 4}},
+	}
+	for _, test := range tests {
+		sp.SetMatchUserDefined(test.matchUserDefined)
+		sp.SetParsedControlWords(test.controlWords)
+		output := sp.TokenizeToIDs(text)
+		if !reflect.DeepEqual(output, test.ids) {
+			t.Errorf("Tokenization error : %v %v, got %v || expected %v", test.matchUserDefined, test.controlWords, output, test.ids)
+		}
+	}
+
+	sp.SetMatchUserDefined(true)
+	sp.SetParsedControlWords([]string{"<sep>"})
+	expected := []TokenOffset{
+		{ID: 17, Text: "▁", Start: 0, End: 0},
+		{ID: 4, Text: "<sep>", Start: 0, End: 5},
+		{ID: 8, Text: "<eop>", Start: 5, End: 10},
+	}
+	if output := sp.TokenizeToOffsets("<sep><eop>"); !reflect.DeepEqual(output, expected) {
+		t.Errorf("Tokenization error : got %v || expected %v", output, expected)
+	}
+	nbest, _ := sp.NBestTokenize("<sep><eop>", 3)
+	if len(nbest) != 1 || !reflect.DeepEqual(nbest[0], expected) {
+		t.Errorf("NBest error : got %v || expected %v", nbest, expected)
+	}
+}
+
+func TestEncodeBatch(t *testing.T) {
+	sp, err := NewSentencepieceFromFile("test_data/xlnet-base-cased-spiece.model", false)
+	if err != nil {
+		t.Errorf("Unable to create sentencepiece")
+		return
+	}
+
+	texts := []string{"this", "This is a sample sentence", ""}
+	ids := [][]int32{{52}, {122, 27, 24, 4561, 3833}, {}}
+	for i, text := range texts {
+		if output := sp.TokenizeToIDs(text); !reflect.DeepEqual(output, ids[i]) {
+			t.Errorf("Tokenization error : %s, got %v || expected %v", text, output, ids[i])
+		}
+	}
+
+	tests := []struct {
+		opts  BatchOptions
+		ids   [][]int32
+		masks [][]int32
+	}{
+		{
+			opts:  BatchOptions{},
+			ids:   [][]int32{{52}, {122, 27, 24, 4561, 3833}, {}},
+			masks: [][]int32{{1}, {1, 1, 1, 1, 1}, {}},
+		},
+		{
+			opts:  BatchOptions{Padding: PadToLongest},
+			ids:   [][]int32{{52, 5, 5, 5, 5}, {122, 27, 24, 4561, 3833}, {5, 5, 5, 5, 5}},
+			masks: [][]int32{{1, 0, 0, 0, 0}, {1, 1, 1, 1, 1}, {0, 0, 0, 0, 0}},
+		},
+		{
+			opts:  BatchOptions{EncodeOptions: EncodeOptions{AddEOS: true}, MaxLength: 3, Padding: PadToLongest, PaddingSide: Left},
+			ids:   [][]int32{{5, 52, 2}, {122, 27, 2}, {5, 5, 2}},
+			masks: [][]int32{{0, 1, 1}, {1, 1, 1}, {0, 0, 1}},
+		},
+		{
+			opts:  BatchOptions{EncodeOptions: EncodeOptions{AddBOS: true}, MaxLength: 3, TruncationSide: Left, Padding: PadToMaxLength, PadToMultipleOf: 4},
+			ids:   [][]int32{{1, 52, 5, 5}, {1, 4561, 3833, 5}, {1, 5, 5, 5}},
+			masks: [][]int32{{1, 1, 0, 0}, {1, 1, 1, 0}, {1, 0, 0, 0}},
+		},
+	}
+	for _, test := range tests {
+		batch := sp.EncodeBatch(texts, test.opts)
+		if !reflect.DeepEqual(batch.InputIDs, test.ids) || !reflect.DeepEqual(batch.AttentionMask, test.masks) {
+			t.Errorf("Batch error : %+v, got %v %v || expected %v %v", test.opts, batch.InputIDs, batch.AttentionMask, test.ids, test.masks)
+		}
+		for i := range batch.InputIDs {
+			if len(batch.TokenTypeIDs[i]) != len(batch.InputIDs[i]) || len(batch.Offsets[i]) != len(batch.InputIDs[i]) {
+				t.Errorf("Batch error : %+v, lengths of sequence %d differ", test.opts, i)
+			}
+			for j, offset := range batch.Offsets[i] {
+				if offset.ID != batch.InputIDs[i][j] {
+					t.Errorf("Batch error : %+v, offset %v does not match id %d", test.opts, offset, batch.InputIDs[i][j])
+				}
+			}
+		}
+	}
+}
+
+func TestPostProcessors(t *testing.T) {
+	xlnet, err := NewSentencepieceFromFile("test_data/xlnet-base-cased-spiece.model", false)
+	if err != nil {
+		t.Errorf("Unable to create sentencepiece")
+		return
+	}
+	albert, err := NewSentencepieceFromFile("test_data/spm.model", true)
+	if err != nil {
+		t.Errorf("Unable to create sentencepiece")
+		return
+	}
+	xlnetProcessor, err := NewXLNetPostProcessor(&xlnet)
+	if err != nil {
+		t.Errorf("Unable to create post processor : %v", err)
+		return
+	}
+	albertProcessor, err := NewALBERTPostProcessor(&albert)
+	if err != nil {
+		t.Errorf("Unable to create post processor : %v", err)
+		return
+	}
+	t5Processor, err := NewT5PostProcessor(&xlnet)
+	if err != nil {
+		t.Errorf("Unable to create post processor : %v", err)
+		return
+	}
+	if _, err := NewT5PostProcessor(&albert); err == nil {
+		t.Errorf("Expected error for missing special piece")
+	}
+
+	long := "This is a sample sentence"
+	tests := []struct {
+		sp        *Sentencepiece
+		processor PostProcessor
+		first     string
+		second    *string
+		opts      BatchOptions
+		ids       []int32
+		typeIDs   []int32
+	}{
+		{sp: &xlnet, processor: xlnetProcessor, first: "this", ids: []int32{52, 4, 3}, typeIDs: []int32{0, 0, 2}},
+		{sp: &xlnet, processor: xlnetProcessor, first: "this", second: proto.String("hello"),
+			ids: []int32{52, 4, 24717, 4, 3}, typeIDs: []int32{0, 0, 1, 1, 2}},
+		{sp: &albert, processor: albertProcessor, first: "this", ids: []int32{2, 48, 3}, typeIDs: []int32{0, 0, 0}},
+		{sp: &albert, processor: albertProcessor, first: "this", second: proto.String("hello"),
+			ids: []int32{2, 48, 3, 10975, 3}, typeIDs: []int32{0, 0, 0, 1, 1}},
+		{sp: &xlnet, processor: t5Processor, first: "this", second: proto.String("hello"),
+			ids: []int32{52, 2, 24717, 2}, typeIDs: []int32{0, 0, 0, 0}},
+		{sp: &albert, processor: albertProcessor, first: long, second: proto.String("hello"),
+			opts: BatchOptions{MaxLength: 6},
+			ids:  []int32{2, 48, 25, 3, 10975, 3}, typeIDs: []int32{0, 0, 0, 0, 1, 1}},
+		{sp: &albert, processor: albertProcessor, first: long, second: proto.String("hello"),
+			opts: BatchOptions{MaxLength: 6, Truncation: OnlyFirst, TruncationSide: Left},
+			ids:  []int32{2, 5717, 5123, 3, 10975, 3}, typeIDs: []int32{0, 0, 0, 0, 1, 1}},
+		{sp: &albert, processor: albertProcessor, first: "hello", second: proto.String(long),
+			opts: BatchOptions{MaxLength: 6, Truncation: OnlySecond},
+			ids:  []int32{2, 10975, 3, 48, 25, 3}, typeIDs: []int32{0, 0, 0, 1, 1, 1}},
+		{sp: &xlnet, processor: xlnetProcessor, first: "this",
+			opts: BatchOptions{MaxLength: 5, Padding: PadToMaxLength},
+			ids:  []int32{5, 5, 52, 4, 3}, typeIDs: []int32{3, 3, 0, 0, 2}},
+		{sp: &xlnet, processor: xlnetProcessor, first: "this",
+			opts: BatchOptions{MaxLength: 5, Padding: PadToMaxLength, PaddingSide: Right},
+			ids:  []int32{52, 4, 3, 5, 5}, typeIDs: []int32{0, 0, 2, 3, 3}},
+		{sp: &albert, processor: albertProcessor, first: "this",
+			opts: BatchOptions{MaxLength: 5, Padding: PadToMaxLength},
+			ids:  []int32{2, 48, 3, 0, 0}, typeIDs: []int32{0, 0, 0, 0, 0}},
+	}
+	for _, test := range tests {
+		var output Encoding
+		if test.second == nil {
+			output = test.sp.EncodeSingle(test.first, test.processor, test.opts)
+		} else {
+			output = test.sp.EncodePair(test.first, *test.second, test.processor, test.opts)
+		}
+		if !reflect.DeepEqual(output.InputIDs, test.ids) || !reflect.DeepEqual(output.TokenTypeIDs, test.typeIDs) {
+			t.Errorf("Encode error : %s, got %v %v || expected %v %v", test.first, output.InputIDs, output.TokenTypeIDs, test.ids, test.typeIDs)
+		}
+	}
+}
+
+func TestTokenizeBatchParallel(t *testing.T) {
+	sp, err := NewSentencepieceFromFile("test_data/xlnet-base-cased-spiece.model", false)
+	if err != nil {
+		t.Errorf("Unable to create sentencepiece")
+		return
+	}
+	texts := []string{
+		"Hello world",
+		"",
+		"Sentencepiece is an unsupervised text tokenizer",
+		"this is a test",
+		"   extra   spaces   ",
+		"ünicode and Ψ symbols",
+		"a somewhat longer sentence which needs a longer lattice than the others",
+	}
+	for _, workers := range []int{0, 1, 3, 16} {
+		results, err := sp.TokenizeBatchParallel(context.Background(), texts, workers)
+		if err != nil {
+			t.Errorf("Unable to tokenize batch with %d workers : %v", workers, err)
+			continue
+		}
+		for i, text := range texts {
+			if expected := sp.TokenizeToOffsets(text); !reflect.DeepEqual(results[i], expected) {
+				t.Errorf("TokenizeBatchParallel(%q) with %d workers got %v, expected %v", text, workers, results[i], expected)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := sp.TokenizeBatchParallel(ctx, texts, 2); err != context.Canceled {
+		t.Errorf("TokenizeBatchParallel with cancelled context got error %v, expected %v", err, context.Canceled)
+	}
+}
+
+func TestDoubleArray(t *testing.T) {
+	entries := []trieEntry{
+		{key: "a", score: -1, index: 1},
+		{key: "ab", score: -2, index: 2},
+		{key: "abc", score: -3, index: 3},
+		{key: "b", score: -4, index: 4},
+		{key: "ü", score: -5, index: 5},
+		{key: "üb", score: -6, index: 6},
+		{key: "\u2581a", score: -7, index: 7},
+		{key: "ab", score: -8, index: 8},
+	}
+	trie := newDoubleArray(entries)
+	tests := []struct {
+		text     string
+		expected []trieNodeMeta
+	}{
+		{text: "abcd", expected: []trieNodeMeta{{1, -1, 1}, {2, -8, 8}, {3, -3, 3}}},
+		{text: "ac", expected: []trieNodeMeta{{1, -1, 1}}},
+		{text: "üba", expected: []trieNodeMeta{{1, -5, 5}, {2, -6, 6}}},
+		{text: "\u2581ab", expected: []trieNodeMeta{{2, -7, 7}}},
+		{text: "\u2581", expected: nil},
+		{text: "c", expected: nil},
+		{text: "", expected: nil},
+	}
+	for _, test := range tests {
+		if matches := trie.commonPrefixSearch(nil, []rune(test.text)); !reflect.DeepEqual(matches, test.expected) {
+			t.Errorf("commonPrefixSearch(%q) got %v, expected %v", test.text, matches, test.expected)
+		}
+	}
+
+	sp, err := NewSentencepieceFromFile("test_data/xlnet-base-cased-spiece.model", false)
+	if err != nil {
+		t.Errorf("Unable to create sentencepiece")
+		return
+	}
+	for i, piece := range sp.pieces {
+		if piece.typ != ModelProto_SentencePiece_NORMAL || sp.pieceIDs[piece.text] != int32(i) {
+			continue
+		}
+		runes := []rune(piece.text)
+		matches := sp.commonPrefixSearch(runes)
+		if len(matches) == 0 || matches[len(matches)-1] != (trieNodeMeta{len(runes), piece.score, int32(i)}) {
+			t.Errorf("commonPrefixSearch(%q) got %v, expected it to end with piece %d", piece.text, matches, i)
+		}
+	}
+}
+
+func TestEncodeIDsInto(t *testing.T) {
+	sp, err := NewSentencepieceFromFile("test_data/xlnet-base-cased-spiece.model", false)
+	if err != nil {
+		t.Errorf("Unable to create sentencepiece")
+		return
+	}
+	symbols, err := NewSentencepieceFromFile("test_data/xlnet-base-cased-spiece.model", false)
+	if err != nil {
+		t.Errorf("Unable to create sentencepiece")
+		return
+	}
+	symbols.SetParsedControlWords([]string{"<sep>", "<cls>"})
+	models := []Sentencepiece{sp, symbols, loadModel(t, newTestBPEModel())}
+	texts := []string{
+		"Hello world",
+		"",
+		"   extra   spaces   ",
+		"ünicode and Ψ symbols<sep>",
+		"a<sep>b<cls>",
+		"a somewhat longer sentence which needs a longer lattice than the others",
+	}
+	for _, model := range models {
+		var scratch Scratch
+		var ids []int32
+		for _, text := range texts {
+			ids = model.EncodeIDsInto(ids[:0], text, &scratch)
+			if expected := model.TokenizeToIDs(text); !reflect.DeepEqual(ids, expected) && len(ids)+len(expected) > 0 {
+				t.Errorf("EncodeIDsInto(%q) got %v, expected %v", text, ids, expected)
+			}
+		}
+		if ids := model.EncodeIDsInto([]int32{1}, "Hello", nil); !reflect.DeepEqual(ids[1:], model.TokenizeToIDs("Hello")) || ids[0] != 1 {
+			t.Errorf("EncodeIDsInto with nil scratch got %v", ids)
+		}
+	}
+
+	var scratch Scratch
+	ids := make([]int32, 0, 256)
+	for _, text := range texts {
+		ids = sp.EncodeIDsInto(ids[:0], text, &scratch)
+	}
+	for _, text := range texts {
+		allocs := testing.AllocsPerRun(100, func() {
+			ids = sp.EncodeIDsInto(ids[:0], text, &scratch)
+		})
+		if allocs != 0 {
+			t.Errorf("EncodeIDsInto(%q) made %v allocations, expected none", text, allocs)
+		}
+	}
+}
+
+func TestOffsetsMode(t *testing.T) {
+	sp, err := NewSentencepieceFromFile("test_data/xlnet-base-cased-spiece.model", false)
+	if err != nil {
+		t.Errorf("Unable to create sentencepiece")
+		return
+	}
+	text := "\ufb01ne \U0001F600 \u00dcn\u00efcode"
+	tests := []struct {
+		mode     OffsetsMode
+		expected [][2]int
+	}{
+		{mode: RuneOffsets, expected: [][2]int{{0, 3}, {3, 4}, {4, 5}, {5, 6}, {6, 7}, {7, 8}, {8, 9}, {9, 13}, {13, 13}}},
+		{mode: ByteOffsets, expected: [][2]int{{0, 5}, {5, 6}, {6, 10}, {10, 11}, {11, 13}, {13, 14}, {14, 16}, {16, 20}, {20, 20}}},
+		{mode: UTF16Offsets, expected: [][2]int{{0, 3}, {3, 4}, {4, 6}, {6, 7}, {7, 8}, {8, 9}, {9, 10}, {10, 14}, {14, 14}}},
+	}
+	for _, test := range tests {
+		sp.SetOffsetsMode(test.mode)
+		tokens := sp.Encode(text, EncodeOptions{AddEOS: true})
+		offsets := make([][2]int, len(tokens))
+		for i, token := range tokens {
+			offsets[i] = [2]int{token.Start, token.End}
+		}
+		if !reflect.DeepEqual(offsets, test.expected) {
+			t.Errorf("Encode(%q) with offsets mode %d got offsets %v, expected %v", text, test.mode, offsets, test.expected)
+		}
+		if test.mode == ByteOffsets && text[tokens[2].Start:tokens[2].End] != "\U0001F600" {
+			t.Errorf("Byte offsets of %v do not slice the text", tokens[2])
+		}
+	}
+}
+
+func TestOffsetAlignment(t *testing.T) {
+	sp, err := NewSentencepieceFromFile("test_data/spm.model", true)
+	if err != nil {
+		t.Errorf("Unable to create sentencepiece")
+		return
+	}
+	sp.SetOffsetsMode(ByteOffsets)
+	tests := []struct {
+		text     string
+		expected []TokenOffset
+	}{
+		{
+			text: "  \u0130stanbul   \uff21\uff22\uff23 \ufb01ne\u200b end  ",
+			expected: []TokenOffset{
+				{ID: 10617, Text: "\u2581istanbul", Start: 2, End: 11},
+				{ID: 5079, Text: "\u2581abc", Start: 11, End: 23},
+				{ID: 1123, Text: "\u2581fine", Start: 23, End: 29},
+				{ID: 241, Text: "\u2581end", Start: 29, End: 36},
+			},
+		},
+		{
+			text: "\u0160\u0153 \u03fa\U00029e3dx",
+			expected: []TokenOffset{
+				{ID: 13, Text: "\u2581", Start: 0, End: 0},
+				{ID: 1, Text: "\u0161\u0153", Start: 0, End: 4},
+				{ID: 13, Text: "\u2581", Start: 4, End: 5},
+				{ID: 1, Text: "\u03fb\U00029e3d", Start: 5, End: 11},
+				{ID: 396, Text: "x", Start: 11, End: 12},
+			},
+		},
+	}
+	for _, test := range tests {
+		tokens := sp.TokenizeToOffsets(test.text)
+		if !reflect.DeepEqual(tokens, test.expected) {
+			t.Errorf("TokenizeToOffsets(%q) got %v, expected %v", test.text, tokens, test.expected)
+		}
+		for i := 1; i < len(tokens); i++ {
+			if tokens[i].Start != tokens[i-1].End {
+				t.Errorf("TokenizeToOffsets(%q) got token %v not starting at the end of %v", test.text, tokens[i], tokens[i-1])
+			}
+		}
+	}
+}
+
+func TestCountTokens(t *testing.T) {
+	sp, err := NewSentencepieceFromFile("test_data/xlnet-base-cased-spiece.model", false)
+	if err != nil {
+		t.Errorf("Unable to create sentencepiece")
+		return
+	}
+	byteFallback := loadByteFallbackModel(t)
+	texts := []string{
+		"Hello world",
+		"",
+		"   extra   spaces   ",
+		"get \U0001F914 \U00029e3d",
+		"\u0160\u0153 \u03fa",
+		"a somewhat longer sentence which needs a longer lattice than the others",
+		"first<sep>\u0160\u0153<sep><sep> second",
+	}
+	symbols := sp
+	symbols.SetParsedControlWords([]string{"<sep>"})
+	for _, model := range []Sentencepiece{sp, byteFallback, symbols, loadModel(t, newTestBPEModel())} {
+		counts := model.CountTokensBatch(texts)
+		for i, text := range texts {
+			expected := len(model.TokenizeToIDs(text))
+			if count := model.CountTokens(text); count != expected {
+				t.Errorf("CountTokens(%q) got %d, expected %d", text, count, expected)
+			}
+			if counts[i] != expected {
+				t.Errorf("CountTokensBatch(%q) got %d, expected %d", text, counts[i], expected)
+			}
+			for _, limit := range []int{-1, 0, expected - 1, expected, expected + 1, len(text) + 1} {
+				if fits := model.FitsWithin(text, limit); fits != (expected <= limit) {
+					t.Errorf("FitsWithin(%q, %d) got %v, expected %v", text, limit, fits, expected <= limit)
+				}
+			}
+		}
+	}
+}
+
+func TestVocab(t *testing.T) {
+	sp := loadModel(t, newTestModel(TrainerSpec_UNIGRAM, []testPiece{
+		{piece: "<unk>", typ: ModelProto_SentencePiece_UNKNOWN},
+		{piece: "<s>", typ: ModelProto_SentencePiece_CONTROL},
+		{piece: "<0x41>", typ: ModelProto_SentencePiece_BYTE},
+		{piece: "<mask>", typ: ModelProto_SentencePiece_USER_DEFINED},
+		{piece: "\u2581old", score: -1, typ: ModelProto_SentencePiece_UNUSED},
+		{piece: "\u2581a", score: -2.5},
+	}))
+	if size := sp.VocabSize(); size != 6 {
+		t.Errorf("VocabSize got %d, expected 6", size)
+	}
+	tests := []struct {
+		id          int32
+		piece       string
+		score       float32
+		unknown     bool
+		control     bool
+		userDefined bool
+		byteID      bool
+		unused      bool
+	}{
+		{id: 0, piece: "<unk>", unknown: true},
+		{id: 1, piece: "<s>", control: true},
+		{id: 2, piece: "<0x41>", byteID: true},
+		{id: 3, piece: "<mask>", userDefined: true},
+		{id: 4, piece: "\u2581old", score: -1, unused: true},
+		{id: 5, piece: "\u2581a", score: -2.5},
+		{id: 6},
+		{id: -1},
+	}
+	for _, test := range tests {
+		if piece := sp.IDToPiece(test.id); piece != test.piece {
+			t.Errorf("IDToPiece(%d) got %q, expected %q", test.id, piece, test.piece)
+		}
+		if score := sp.GetScore(test.id); score != test.score {
+			t.Errorf("GetScore(%d) got %v, expected %v", test.id, score, test.score)
+		}
+		types := []bool{sp.IsUnknown(test.id), sp.IsControl(test.id), sp.IsUserDefined(test.id), sp.IsByte(test.id), sp.IsUnused(test.id)}
+		expected := []bool{test.unknown, test.control, test.userDefined, test.byteID, test.unused}
+		if !reflect.DeepEqual(types, expected) {
+			t.Errorf("Types of %d got %v, expected %v", test.id, types, expected)
+		}
+		if test.piece != "" {
+			if id := sp.PieceToID(test.piece); id != test.id {
+				t.Errorf("PieceToID(%q) got %d, expected %d", test.piece, id, test.id)
+			}
+		}
+	}
+	if id := sp.PieceToID("missing"); id != 0 {
+		t.Errorf("PieceToID of a missing piece got %d, expected the unknown id", id)
+	}
+}
+
+func TestSaveModel(t *testing.T) {
+	for _, filename := range []string{"test_data/xlnet-base-cased-spiece.model", "test_data/spm.model"} {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Errorf("Unable to read model file : %v", err)
+			continue
+		}
+		sp, err := NewSentencepieceFromBytes(data, false)
+		if err != nil {
+			t.Errorf("Unable to create sentencepiece : %v", err)
+			continue
+		}
+		var buf bytes.Buffer
+		if n, err := sp.WriteTo(&buf); err != nil || n != int64(len(data)) {
+			t.Errorf("WriteTo got %d bytes, err %v, expected %d bytes", n, err, len(data))
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Errorf("WriteTo got bytes which differ from %s", filename)
+		}
+	}
+
+	sp := loadModifiedModel(t, "test_data/xlnet-base-cased-spiece.model", func(model *ModelProto) {
+		model.NormalizerSpec.AddDummyPrefix = proto.Bool(false)
+		model.TrainerSpec.UnkSurface = proto.String("<?>")
+	})
+	dir, err := ioutil.TempDir("", "sentencepiece")
+	if err != nil {
+		t.Errorf("Unable to create temp dir : %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	filename := dir + "/saved.model"
+	if err := sp.SaveModel(filename); err != nil {
+		t.Errorf("Unable to save model : %v", err)
+		return
+	}
+	saved, err := NewSentencepieceFromFile(filename, false)
+	if err != nil {
+		t.Errorf("Unable to load saved model : %v", err)
+		return
+	}
+	text := "Hello World, this is a ŧest"
+	if tokens, expected := saved.TokenizeToOffsets(text), sp.TokenizeToOffsets(text); !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("Saved model tokenized %q into %v, expected %v", text, tokens, expected)
+	}
+	if decoded, _ := saved.DecodeIDs([]int32{0}); decoded != "<?>" {
+		t.Errorf("Saved model decoded the unknown piece into %q, expected %q", decoded, "<?>")
+	}
+
+	empty := NewEmptySentencepiece(false)
+	empty.addPiece("<unk>", 0, ModelProto_SentencePiece_UNKNOWN)
+	model := empty.ModelProto()
+	if len(model.GetPieces()) != 1 || model.GetTrainerSpec().GetModelType() != TrainerSpec_UNIGRAM || !model.GetNormalizerSpec().GetAddDummyPrefix() {
+		t.Errorf("ModelProto of an empty model got %v", model)
+	}
+}
+
+func TestModelEditor(t *testing.T) {
+	sp, err := NewSentencepieceFromFile("test_data/xlnet-base-cased-spiece.model", false)
+	if err != nil {
+		t.Fatalf("Unable to create sentencepiece : %v", err)
+	}
+	sp.SetMatchUserDefined(true)
+	size := sp.VocabSize()
+	the := sp.PieceToID("▁the")
+
+	editor, err := sp.Edit()
+	if err != nil {
+		t.Fatalf("Unable to edit model : %v", err)
+	}
+	code, err := editor.AddPiece("<|code|>", 0, ModelProto_SentencePiece_USER_DEFINED)
+	if err != nil || int(code) != size {
+		t.Errorf("AddPiece got id %d, err %v, expected id %d", code, err, size)
+	}
+	if _, err := editor.AddPiece("sku", -20, ModelProto_SentencePiece_NORMAL); err != nil {
+		t.Errorf("AddPiece got err %v", err)
+	}
+	if err := editor.SetScore("sku", 0); err != nil {
+		t.Errorf("SetScore got err %v", err)
+	}
+	if err := editor.DisablePiece("▁the"); err != nil {
+		t.Errorf("DisablePiece got err %v", err)
+	}
+	failures := []struct {
+		name string
+		edit func() error
+	}{
+		{"duplicate piece", func() error { _, err := editor.AddPiece("▁the", 0, ModelProto_SentencePiece_NORMAL); return err }},
+		{"second unknown piece", func() error { _, err := editor.AddPiece("<unk2>", 0, ModelProto_SentencePiece_UNKNOWN); return err }},
+		{"invalid byte piece", func() error { _, err := editor.AddPiece("<0xZZ>", 0, ModelProto_SentencePiece_BYTE); return err }},
+		{"missing piece", func() error { return editor.SetScore("missing", 0) }},
+		{"disable unknown piece", func() error { return editor.DisablePiece("<unk>") }},
+		{"remove piece before the last", func() error { return editor.RemovePiece("<|code|>") }},
+	}
+	for _, failure := range failures {
+		if err := failure.edit(); err == nil {
+			t.Errorf("Edit with %s got no error", failure.name)
+		}
+	}
+	if err := editor.Apply(&sp); err != nil {
+		t.Fatalf("Apply got err %v", err)
+	}
+
+	if sp.VocabSize() != size+2 || sp.IDToPiece(the) != "▁the" || !sp.IsUnused(the) {
+		t.Errorf("Apply got vocab size %d and piece %q, expected stable ids", sp.VocabSize(), sp.IDToPiece(the))
+	}
+	tokens := sp.TokenizeToIDs("the<|code|>sku")
+	if len(tokens) == 0 || tokens[0] == the || !reflect.DeepEqual(tokens[len(tokens)-2:], []int32{code, code + 1}) {
+		t.Errorf("TokenizeToIDs after Apply got %v", sp.Tokenize("the<|code|>sku"))
+	}
+
+	if err := editor.RemovePiece("sku"); err != nil {
+		t.Errorf("RemovePiece got err %v", err)
+	}
+	editor.Model().TrainerSpec.BosId = proto.Int32(code)
+	if err := editor.Apply(&sp); err == nil {
+		t.Errorf("Apply with a user defined bos_id got no error")
+	}
+	if sp.VocabSize() != size+2 {
+		t.Errorf("Apply with an invalid model changed the vocab size to %d", sp.VocabSize())
+	}
+
+	pieces := []testPiece{
+		{piece: "<unk>", typ: ModelProto_SentencePiece_UNKNOWN},
+		{piece: "▁hello", score: -1},
+		{piece: "▁world", score: -2},
+		{piece: "▁", score: -3},
+		{piece: "a", score: -4},
+		{piece: "b", score: -5},
+		{piece: "▁a", score: -6},
+	}
+	tests := []struct {
+		modelType TrainerSpec_ModelType
+		disabled  string
+		text      string
+		ids       []int32
+	}{
+		{modelType: TrainerSpec_WORD, disabled: "▁hello", text: "hello world", ids: []int32{0, 2}},
+		{modelType: TrainerSpec_CHAR, disabled: "a", text: "ab", ids: []int32{3, 0, 5}},
+		{modelType: TrainerSpec_BPE, disabled: "a", text: "ba", ids: []int32{3, 5, 0}},
+		{modelType: TrainerSpec_BPE, disabled: "▁a", text: "a", ids: []int32{3, 4}},
+	}
+	for _, test := range tests {
+		sp := loadModel(t, newTestModel(test.modelType, pieces))
+		editor, err := sp.Edit()
+		if err != nil {
+			t.Fatalf("Unable to edit model : %v", err)
+		}
+		if err := editor.DisablePiece(test.disabled); err != nil {
+			t.Errorf("DisablePiece got err %v", err)
+		}
+		if err := editor.Apply(&sp); err != nil {
+			t.Fatalf("Apply got err %v", err)
+		}
+		if output := sp.TokenizeToIDs(test.text); !reflect.DeepEqual(output, test.ids) {
+			t.Errorf("TokenizeToIDs with %v and %q disabled : %s, got %v || expected %v", test.modelType, test.disabled, test.text, output, test.ids)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	sp, err := NewSentencepieceFromFile("test_data/xlnet-base-cased-spiece.model", false)
+	if err != nil {
+		t.Errorf("Unable to create sentencepiece")
+		return
+	}
+
+	texts := []string{
+		"this",
+		"This is a sample sentence",
+		"compose email to john saying i will be running late to office today",
+	}
+	for _, text := range texts {
+		output, err := sp.DecodeIDs(sp.TokenizeToIDs(text))
+		if err != nil || output != text {
+			t.Errorf("Decode error : %s, got %q, err %v", text, output, err)
+		}
+	}
+
+	tests := []struct {
+		ids  []int32
+		text string
+	}{
+		{ids: []int32{1, 122, 27, 2}, text: "This is"},
+		{ids: []int32{17, 0, 17, 82}, text: " ⁇  ?"},
+		{ids: []int32{3, 17366, 1227, 4}, text: "tokenized"},
+	}
+	for _, test := range tests {
+		output, err := sp.DecodeIDs(test.ids)
+		if err != nil || output != test.text {
+			t.Errorf("Decode error : %v, got %q || expected %q", test.ids, output, test.text)
+		}
+	}
+
+	if _, err := sp.DecodeIDs([]int32{32000}); err == nil {
+		t.Errorf("Expected error for out of range id")
+	}
+
+	output := sp.DecodePieces([]string{"<s>", "▁Wonder", "ing", "▁how", "🤔", "</s>"})
+	if output != "Wondering how🤔" {
+		t.Errorf("DecodePieces error : got %q", output)
+	}
+	if output := sp.DecodePieces([]string{"▁how", "▁🤔"}); output != "how▁🤔" {
+		t.Errorf("DecodePieces error : got %q", output)
+	}
+
+	spaces := loadModel(t, newTestModel(TrainerSpec_UNIGRAM, []testPiece{
+		{piece: "<unk>", typ: ModelProto_SentencePiece_UNKNOWN},
+		{piece: "▁▁a", score: -1},
+	}))
+	if output, err := spaces.DecodeIDs([]int32{1, 1}); err != nil || output != " a  a" {
+		t.Errorf("Decode error : got %q, err %v", output, err)
+	}
+}
+
 func BenchmarkSentencePiece(b *testing.B) {
+	b.Run("load", func(b *testing.B) {
+		b.ReportAllocs()
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		models := make([]Sentencepiece, b.N)
+		for i := 0; i < b.N; i++ {
+			sp, err := NewSentencepieceFromFile("test_data/xlnet-base-cased-spiece.model", false)
+			if err != nil {
+				b.Errorf("Unable to create sentencepiece")
+				return
+			}
+			models[i] = sp
+		}
+		b.StopTimer()
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(b.N), "heap-B/model")
+		runtime.KeepAlive(models)
+	})
+
 	sp, err := NewSentencepieceFromFile("test_data/xlnet-base-cased-spiece.model", false)
 	if err != nil {
 		b.Errorf("Unable to create sentencepiece")
@@ -405,6 +1721,8 @@ func BenchmarkSentencePiece(b *testing.B) {
 
 	for _, input := range inputs {
 		b.Run(firstNChars(input, 20), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(input)))
 			for i := 0; i < b.N; i++ {
 				sp.Tokenize(input)
 			}
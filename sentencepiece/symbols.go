@@ -0,0 +1,85 @@
+package sentencepiece
+
+// SetMatchUserDefined sets whether user defined pieces found in the text are
+// always tokenized as a whole, instead of competing with the other pieces.
+func (s *Sentencepiece) SetMatchUserDefined(match bool) {
+	s.matchUserDefined = match
+	s.buildSymbols()
+}
+
+// SetParsedControlWords sets the control words which are tokenized into
+// their ids when found in the text.
+func (s *Sentencepiece) SetParsedControlWords(words []string) {
+	s.parsedControlWords = append([]string(nil), words...)
+	s.buildSymbols()
+}
+
+func (s *Sentencepiece) buildSymbols() {
+	s.symbols = make(map[string]int32)
+	s.maxSymbolLength = 0
+	add := func(word string, index int32) {
+		if word == "" {
+			return
+		}
+		s.symbols[word] = index
+		if len(word) > s.maxSymbolLength {
+			s.maxSymbolLength = len(word)
+		}
+	}
+	if s.matchUserDefined {
+		for i, piece := range s.pieces {
+			if piece.typ == ModelProto_SentencePiece_USER_DEFINED {
+				add(piece.text, int32(i))
+			}
+		}
+	}
+	for _, word := range s.parsedControlWords {
+		if index, ok := s.controlWords[word]; ok {
+			add(word, index)
+		}
+	}
+}
+
+// matchSymbol returns the longest symbol which text starts with, as a slice
+// of the bytes of text.
+func (s *Sentencepiece) matchSymbol(text string) (slice, bool) {
+	if len(s.symbols) == 0 {
+		return slice{}, false
+	}
+	length := s.maxSymbolLength
+	if length > len(text) {
+		length = len(text)
+	}
+	for ; length > 0; length-- {
+		if index, ok := s.symbols[text[:length]]; ok {
+			var score float32
+			if int(index) < len(s.pieces) {
+				score = s.pieces[index].score
+			}
+			return slice{score: score, index: index, start: 0, end: length}, true
+		}
+	}
+	return slice{}, false
+}
+
+// encodeAroundSymbols segments the runes between the symbols with encode,
+// appending the slices to dst.
+func encodeAroundSymbols(dst []slice, runes []rune, symbols []slice, encode func(runes []rune) []slice) []slice {
+	slices := dst
+	start := 0
+	for _, symbol := range symbols {
+		slices = appendShifted(slices, encode(runes[start:symbol.start]), start)
+		slices = append(slices, symbol)
+		start = symbol.end
+	}
+	return appendShifted(slices, encode(runes[start:]), start)
+}
+
+func appendShifted(slices []slice, shifted []slice, offset int) []slice {
+	for _, sl := range shifted {
+		sl.start += offset
+		sl.end += offset
+		slices = append(slices, sl)
+	}
+	return slices
+}
@@ -6,6 +6,9 @@ type Token struct {
 	Text string
 }
 
+// TokenOffset holds a token along with the span of the input it was produced
+// from. Input removed by the normalization, like extra whitespace, is part of
+// the span of the following token.
 type TokenOffset struct {
 	ID    int32
 	Text  string
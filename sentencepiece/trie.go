@@ -0,0 +1,179 @@
+package sentencepiece
+
+import (
+	"sort"
+	"unicode/utf8"
+)
+
+// trieEntry is a piece to be stored in the trie.
+type trieEntry struct {
+	key   string
+	score float32
+	index int32
+}
+
+type trieLeaf struct {
+	score float32
+	index int32
+}
+
+// doubleArray is a double-array trie over the UTF-8 bytes of the pieces, in
+// the style of Darts. The child of node n for byte c is the node
+// base[n] + c, which is valid when check of that node is n. Nodes which end a
+// piece have the position of its leaf in values, and -1 otherwise.
+type doubleArray struct {
+	base   []int32
+	check  []int32
+	values []int32
+	leaves []trieLeaf
+}
+
+// newDoubleArray builds the trie for entries. When several entries have the
+// same key, the last one is kept.
+func newDoubleArray(entries []trieEntry) *doubleArray {
+	keys := make([]trieEntry, len(entries))
+	for i, entry := range entries {
+		// Invalid UTF-8 is stored as the replacement runes it is read as.
+		keys[i] = trieEntry{key: string([]rune(entry.key)), score: entry.score, index: entry.index}
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].key < keys[j].key
+	})
+	unique := keys[:0]
+	for _, entry := range keys {
+		if len(unique) > 0 && unique[len(unique)-1].key == entry.key {
+			unique[len(unique)-1] = entry
+			continue
+		}
+		unique = append(unique, entry)
+	}
+
+	b := &doubleArrayBuilder{keys: unique, nextCheck: 1}
+	b.resize(256)
+	b.check[0] = 0
+	b.build(0, 0, 0, len(unique))
+
+	size := b.size + 1
+	return &doubleArray{
+		base:   b.base[:size:size],
+		check:  b.check[:size:size],
+		values: b.values[:size:size],
+		leaves: b.leaves,
+	}
+}
+
+// commonPrefixSearch appends to dst the pieces which are prefixes of runes.
+func (t *doubleArray) commonPrefixSearch(dst []trieNodeMeta, runes []rune) []trieNodeMeta {
+	if t == nil {
+		return dst
+	}
+	var buf [utf8.UTFMax]byte
+	node := int32(0)
+	for i, r := range runes {
+		n := utf8.EncodeRune(buf[:], r)
+		for _, c := range buf[:n] {
+			next := t.base[node] + int32(c)
+			if int(next) >= len(t.check) || t.check[next] != node {
+				return dst
+			}
+			node = next
+		}
+		if value := t.values[node]; value >= 0 {
+			leaf := t.leaves[value]
+			dst = append(dst, trieNodeMeta{level: i + 1, score: leaf.score, index: leaf.index})
+		}
+	}
+	return dst
+}
+
+type doubleArrayBuilder struct {
+	keys      []trieEntry
+	base      []int32
+	check     []int32
+	values    []int32
+	leaves    []trieLeaf
+	size      int32
+	nextCheck int32
+}
+
+func (b *doubleArrayBuilder) resize(size int) {
+	for len(b.check) < size {
+		b.base = append(b.base, 0)
+		b.check = append(b.check, -1)
+		b.values = append(b.values, -1)
+	}
+}
+
+// build places the children of node for keys[lo:hi], which share their
+// first depth bytes.
+func (b *doubleArrayBuilder) build(node int32, depth, lo, hi int) {
+	if lo < hi && len(b.keys[lo].key) == depth {
+		b.values[node] = int32(len(b.leaves))
+		b.leaves = append(b.leaves, trieLeaf{score: b.keys[lo].score, index: b.keys[lo].index})
+		lo++
+	}
+	if lo == hi {
+		return
+	}
+
+	var labels []byte
+	var bounds []int
+	for i := lo; i < hi; i++ {
+		c := b.keys[i].key[depth]
+		if len(labels) == 0 || labels[len(labels)-1] != c {
+			labels = append(labels, c)
+			bounds = append(bounds, i)
+		}
+	}
+	bounds = append(bounds, hi)
+
+	base := b.findBase(labels)
+	b.base[node] = base
+	for _, c := range labels {
+		child := base + int32(c)
+		b.check[child] = node
+		if child > b.size {
+			b.size = child
+		}
+	}
+	for i, c := range labels {
+		b.build(base+int32(c), depth+1, bounds[i], bounds[i+1])
+	}
+}
+
+// findBase returns the first base for which the nodes of all labels are free.
+// Like Darts it skips the start of the array once it is mostly occupied.
+func (b *doubleArrayBuilder) findBase(labels []byte) int32 {
+	first := int32(labels[0])
+	pos := b.nextCheck
+	if pos <= first {
+		pos = first + 1
+	}
+	occupied := 0
+	isFirstFree := true
+	for ; ; pos++ {
+		b.resize(int(pos) + 256)
+		if b.check[pos] >= 0 {
+			occupied++
+			continue
+		}
+		if isFirstFree {
+			b.nextCheck = pos
+			isFirstFree = false
+		}
+		base := pos - first
+		isFree := true
+		for _, c := range labels[1:] {
+			if b.check[base+int32(c)] >= 0 {
+				isFree = false
+				break
+			}
+		}
+		if isFree {
+			if float64(occupied)/float64(pos-b.nextCheck+1) >= 0.95 {
+				b.nextCheck = pos
+			}
+			return base
+		}
+	}
+}
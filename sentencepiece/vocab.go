@@ -0,0 +1,60 @@
+package sentencepiece
+
+// VocabSize returns the number of pieces in the vocab
+func (s *Sentencepiece) VocabSize() int {
+	return len(s.pieces)
+}
+
+// IDToPiece returns the piece of id, or an empty string if id is not in the vocab
+func (s *Sentencepiece) IDToPiece(id int32) string {
+	if !s.isValidID(id) {
+		return ""
+	}
+	return s.pieces[id].text
+}
+
+// PieceToID returns the id of piece, or the unknown id if piece is not in the vocab
+func (s *Sentencepiece) PieceToID(piece string) int32 {
+	return s.pieceID(piece)
+}
+
+// GetScore returns the score of the piece of id
+func (s *Sentencepiece) GetScore(id int32) float32 {
+	if !s.isValidID(id) {
+		return 0
+	}
+	return s.pieces[id].score
+}
+
+// IsUnknown returns whether id is the unknown piece
+func (s *Sentencepiece) IsUnknown(id int32) bool {
+	return s.isPieceType(id, ModelProto_SentencePiece_UNKNOWN)
+}
+
+// IsControl returns whether id is a control piece, like BOS and EOS
+func (s *Sentencepiece) IsControl(id int32) bool {
+	return s.isControlID(id)
+}
+
+// IsUserDefined returns whether id is a user defined piece
+func (s *Sentencepiece) IsUserDefined(id int32) bool {
+	return s.isPieceType(id, ModelProto_SentencePiece_USER_DEFINED)
+}
+
+// IsByte returns whether id is a byte piece used for byte fallback
+func (s *Sentencepiece) IsByte(id int32) bool {
+	return s.isByteID(id)
+}
+
+// IsUnused returns whether id is an unused piece
+func (s *Sentencepiece) IsUnused(id int32) bool {
+	return s.isPieceType(id, ModelProto_SentencePiece_UNUSED)
+}
+
+func (s *Sentencepiece) isValidID(id int32) bool {
+	return id >= 0 && int(id) < len(s.pieces)
+}
+
+func (s *Sentencepiece) isPieceType(id int32, typ ModelProto_SentencePiece_Type) bool {
+	return s.isValidID(id) && s.pieces[id].typ == typ
+}
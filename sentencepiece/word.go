@@ -0,0 +1,26 @@
+package sentencepiece
+
+// encodeWords splits runes into words starting at each whitespace symbol and
+// looks up every word as a whole piece.
+func (s *Sentencepiece) encodeWords(runes []rune) []slice {
+	slices := make([]slice, 0, len(runes)/4+1)
+	start := 0
+	for i := 1; i <= len(runes); i++ {
+		if i < len(runes) && runes[i] != sep {
+			continue
+		}
+		slices = append(slices, s.pieceSlice(runes, start, i))
+		start = i
+	}
+	return slices
+}
+
+// pieceSlice returns the slice for the piece runes[start:end], or an unknown
+// slice when it is not in the vocab.
+func (s *Sentencepiece) pieceSlice(runes []rune, start, end int) slice {
+	index, ok := s.lookupPiece(string(runes[start:end]))
+	if !ok {
+		return slice{index: s.unknown, start: start, end: end}
+	}
+	return slice{score: s.pieces[index].score, index: index, start: start, end: end}
+}
@@ -0,0 +1,260 @@
+package trainer
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+)
+
+type bpePair struct {
+	left  int32
+	right int32
+}
+
+// bpePosition is the position of the left symbol of a pair in a word
+type bpePosition struct {
+	word int
+	pos  int
+}
+
+type bpePairStat struct {
+	freq      int64
+	positions []bpePosition
+}
+
+// bpeWord is a word as a linked list of symbols. Merged symbols are -1.
+type bpeWord struct {
+	symbols []int32
+	prev    []int
+	next    []int
+	freq    int64
+}
+
+type bpeCandidate struct {
+	pair  bpePair
+	piece string
+	freq  int64
+}
+
+// bpeQueue is a max-heap of candidate pairs ordered by frequency, and by
+// piece for pairs with the same frequency. Entries are not updated in place:
+// a new entry is pushed when the frequency of a pair changes, and stale
+// entries are skipped when popped.
+type bpeQueue []bpeCandidate
+
+func (q bpeQueue) Len() int { return len(q) }
+
+func (q bpeQueue) Less(i, j int) bool {
+	if q[i].freq != q[j].freq {
+		return q[i].freq > q[j].freq
+	}
+	return q[i].piece < q[j].piece
+}
+
+func (q bpeQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *bpeQueue) Push(x interface{}) { *q = append(*q, x.(bpeCandidate)) }
+
+func (q *bpeQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	candidate := old[n-1]
+	*q = old[:n-1]
+	return candidate
+}
+
+// bpeTrainer merges the most frequent pair of symbols of the words until the
+// vocab is full.
+type bpeTrainer struct {
+	*trainer
+	words     []bpeWord
+	symbols   []string
+	symbolIDs map[string]int32
+	stats     map[bpePair]*bpePairStat
+	valid     map[bpePair]bool
+	dirty     map[bpePair]bool
+	queue     bpeQueue
+}
+
+// trainBPE trains a BPE model. The merged pieces are scored by the order of
+// their merges, followed by the required characters.
+func (t *trainer) trainBPE() ([]scoredPiece, error) {
+	chars := make([]scoredPiece, 0, len(t.required))
+	for r, freq := range t.required {
+		chars = append(chars, scoredPiece{piece: string(r), score: float64(freq)})
+	}
+	sortPieces(chars)
+	isMeta := make(map[string]bool)
+	for _, piece := range t.metaPieces {
+		isMeta[piece.GetPiece()] = true
+	}
+
+	size := int(t.spec.GetVocabSize()) - len(t.metaPieces) - len(chars)
+	if size < 0 {
+		return nil, fmt.Errorf("Unable to fit the required characters : %d, vocab size %d", len(t.required)+len(t.metaPieces), t.spec.GetVocabSize())
+	}
+
+	b := &bpeTrainer{
+		trainer:   t,
+		symbolIDs: make(map[string]int32),
+		stats:     make(map[bpePair]*bpePairStat),
+		valid:     make(map[bpePair]bool),
+		dirty:     make(map[bpePair]bool),
+	}
+	b.initWords()
+
+	var merged []string
+	isPiece := make(map[string]bool)
+	for _, char := range chars {
+		isPiece[char.piece] = true
+	}
+	for len(merged) < size && b.queue.Len() > 0 {
+		candidate := heap.Pop(&b.queue).(bpeCandidate)
+		stat, ok := b.stats[candidate.pair]
+		if !ok || stat.freq != candidate.freq || stat.freq <= 0 {
+			continue
+		}
+		b.merge(candidate.pair, candidate.piece)
+		if !isPiece[candidate.piece] && !isMeta[candidate.piece] {
+			isPiece[candidate.piece] = true
+			merged = append(merged, candidate.piece)
+		}
+	}
+	if len(merged) < size && t.spec.GetHardVocabLimit() {
+		return nil, fmt.Errorf("Unable to fill the vocab : vocab size %d, only %d pieces found", t.spec.GetVocabSize(), len(merged)+len(chars)+len(t.metaPieces))
+	}
+
+	pieces := make([]scoredPiece, 0, len(merged)+len(chars))
+	for _, piece := range merged {
+		pieces = append(pieces, scoredPiece{piece: piece, score: -float64(len(pieces))})
+	}
+	for _, char := range chars {
+		if !isMeta[char.piece] {
+			pieces = append(pieces, scoredPiece{piece: char.piece, score: -float64(len(pieces))})
+		}
+	}
+	return pieces, nil
+}
+
+// initWords splits the words into their characters and counts their pairs
+func (b *bpeTrainer) initWords() {
+	b.words = make([]bpeWord, len(b.trainer.words))
+	for i, w := range b.trainer.words {
+		if len(w.runes) == 0 {
+			continue
+		}
+		word := bpeWord{
+			symbols: make([]int32, len(w.runes)),
+			prev:    make([]int, len(w.runes)),
+			next:    make([]int, len(w.runes)),
+			freq:    w.freq,
+		}
+		for j, r := range w.runes {
+			word.symbols[j] = b.symbolID(string(r))
+			word.prev[j] = j - 1
+			word.next[j] = j + 1
+		}
+		word.next[len(w.runes)-1] = -1
+		b.words[i] = word
+		for j := 1; j < len(w.runes); j++ {
+			b.addPair(bpePair{word.symbols[j-1], word.symbols[j]}, word.freq, bpePosition{word: i, pos: j - 1})
+		}
+	}
+	b.pushDirty()
+}
+
+func (b *bpeTrainer) symbolID(symbol string) int32 {
+	if id, ok := b.symbolIDs[symbol]; ok {
+		return id
+	}
+	id := int32(len(b.symbols))
+	b.symbols = append(b.symbols, symbol)
+	b.symbolIDs[symbol] = id
+	return id
+}
+
+// addPair adds freq occurrences of pair at position, if the pair would make a
+// valid piece.
+func (b *bpeTrainer) addPair(pair bpePair, freq int64, position bpePosition) {
+	valid, ok := b.valid[pair]
+	if !ok {
+		valid = b.isValidPiece([]rune(b.symbols[pair.left] + b.symbols[pair.right]))
+		b.valid[pair] = valid
+	}
+	if !valid {
+		return
+	}
+	stat, ok := b.stats[pair]
+	if !ok {
+		stat = &bpePairStat{}
+		b.stats[pair] = stat
+	}
+	stat.freq += freq
+	stat.positions = append(stat.positions, position)
+	b.dirty[pair] = true
+}
+
+// removePair removes freq occurrences of pair. Its positions are checked
+// when it is merged.
+func (b *bpeTrainer) removePair(pair bpePair, freq int64) {
+	if stat, ok := b.stats[pair]; ok {
+		stat.freq -= freq
+		b.dirty[pair] = true
+	}
+}
+
+// pushDirty pushes the pairs whose frequency changed to the queue
+func (b *bpeTrainer) pushDirty() {
+	pairs := make([]bpePair, 0, len(b.dirty))
+	for pair := range b.dirty {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].left != pairs[j].left {
+			return pairs[i].left < pairs[j].left
+		}
+		return pairs[i].right < pairs[j].right
+	})
+	for _, pair := range pairs {
+		delete(b.dirty, pair)
+		if stat, ok := b.stats[pair]; ok && stat.freq > 0 {
+			heap.Push(&b.queue, bpeCandidate{pair: pair, piece: b.symbols[pair.left] + b.symbols[pair.right], freq: stat.freq})
+		}
+	}
+}
+
+// merge replaces the occurrences of pair with the symbol of piece, updating
+// the frequencies of the pairs with their neighbours.
+func (b *bpeTrainer) merge(pair bpePair, piece string) {
+	id := b.symbolID(piece)
+	stat := b.stats[pair]
+	delete(b.stats, pair)
+	for _, position := range stat.positions {
+		w := &b.words[position.word]
+		i := position.pos
+		next := w.next[i]
+		if w.symbols[i] != pair.left || next < 0 || w.symbols[next] != pair.right {
+			continue
+		}
+		prev, after := w.prev[i], w.next[next]
+		if prev >= 0 {
+			b.removePair(bpePair{w.symbols[prev], pair.left}, w.freq)
+		}
+		if after >= 0 {
+			b.removePair(bpePair{pair.right, w.symbols[after]}, w.freq)
+		}
+		w.symbols[i] = id
+		w.symbols[next] = -1
+		w.next[i] = after
+		if after >= 0 {
+			w.prev[after] = i
+		}
+		if prev >= 0 {
+			b.addPair(bpePair{w.symbols[prev], id}, w.freq, bpePosition{word: position.word, pos: prev})
+		}
+		if after >= 0 {
+			b.addPair(bpePair{id, w.symbols[after]}, w.freq, bpePosition{word: position.word, pos: i})
+		}
+	}
+	b.pushDirty()
+}
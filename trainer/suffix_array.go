@@ -0,0 +1,124 @@
+package trainer
+
+import "sort"
+
+// repeatedSubstring is a substring of a text along with the sum of the
+// weights of its occurrences
+type repeatedSubstring struct {
+	start  int
+	length int
+	freq   int64
+}
+
+// suffixArray returns the suffixes of text in lexicographic order, built by
+// prefix doubling.
+func suffixArray(text []int32) []int {
+	n := len(text)
+	sa := make([]int, n)
+	rank := make([]int, n)
+	next := make([]int, n)
+	for i := range text {
+		sa[i] = i
+	}
+	sort.Slice(sa, func(a, b int) bool {
+		return text[sa[a]] < text[sa[b]]
+	})
+	for i := 1; i < n; i++ {
+		rank[sa[i]] = rank[sa[i-1]]
+		if text[sa[i]] != text[sa[i-1]] {
+			rank[sa[i]]++
+		}
+	}
+	for k := 1; ; k *= 2 {
+		key := func(i int) int {
+			if i+k < n {
+				return rank[i+k]
+			}
+			return -1
+		}
+		sort.Slice(sa, func(a, b int) bool {
+			if rank[sa[a]] != rank[sa[b]] {
+				return rank[sa[a]] < rank[sa[b]]
+			}
+			return key(sa[a]) < key(sa[b])
+		})
+		if n > 0 {
+			next[sa[0]] = 0
+		}
+		for i := 1; i < n; i++ {
+			next[sa[i]] = next[sa[i-1]]
+			if rank[sa[i]] != rank[sa[i-1]] || key(sa[i]) != key(sa[i-1]) {
+				next[sa[i]]++
+			}
+		}
+		copy(rank, next)
+		if n == 0 || rank[sa[n-1]] == n-1 {
+			return sa
+		}
+	}
+}
+
+// longestCommonPrefixes returns for each suffix of sa the length of its
+// common prefix with the previous one, with Kasai's algorithm.
+func longestCommonPrefixes(text []int32, sa []int) []int {
+	n := len(text)
+	rank := make([]int, n)
+	for i, suffix := range sa {
+		rank[suffix] = i
+	}
+	lcp := make([]int, n)
+	h := 0
+	for i := 0; i < n; i++ {
+		if rank[i] == 0 {
+			h = 0
+			continue
+		}
+		j := sa[rank[i]-1]
+		for i+h < n && j+h < n && text[i+h] == text[j+h] {
+			h++
+		}
+		lcp[rank[i]] = h
+		if h > 0 {
+			h--
+		}
+	}
+	return lcp
+}
+
+// repeatedSubstrings returns the substrings of text occurring at least twice
+// which are not extended by the same character in all their occurrences, i.e.
+// the internal nodes of the suffix tree. The frequency of a substring sums the
+// weights of the positions it occurs at.
+func repeatedSubstrings(text []int32, weights []int64) []repeatedSubstring {
+	sa := suffixArray(text)
+	lcp := longestCommonPrefixes(text, sa)
+	// sums holds the sum of the weights of the first suffixes of sa
+	sums := make([]int64, len(sa)+1)
+	for i, suffix := range sa {
+		sums[i+1] = sums[i] + weights[suffix]
+	}
+
+	type interval struct {
+		length int
+		left   int
+	}
+	var output []repeatedSubstring
+	stack := []interval{{0, 0}}
+	for i := 1; i <= len(sa); i++ {
+		length := 0
+		if i < len(sa) {
+			length = lcp[i]
+		}
+		left := i - 1
+		for stack[len(stack)-1].length > length {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			output = append(output, repeatedSubstring{start: sa[top.left], length: top.length, freq: sums[i] - sums[top.left]})
+			left = top.left
+		}
+		if stack[len(stack)-1].length < length {
+			stack = append(stack, interval{length: length, left: left})
+		}
+	}
+	return output
+}
@@ -0,0 +1,480 @@
+// Package trainer trains sentencepiece models from a text corpus, following
+// the options of a TrainerSpec like spm_train.
+package trainer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/susanhuhu/go-sentencepiece-encoder/sentencepiece"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// wsChar is the escaped whitespace which starts the words
+	wsChar rune = 0x2581
+	// unkChar replaces the characters left out by the character coverage
+	unkChar rune = 0x2585
+)
+
+type word struct {
+	runes []rune
+	freq  int64
+}
+
+// scoredPiece is a candidate piece along with its score or frequency
+type scoredPiece struct {
+	piece string
+	score float64
+}
+
+type trainer struct {
+	spec       *sentencepiece.TrainerSpec
+	words      []word
+	required   map[rune]int64
+	metaPieces []*sentencepiece.ModelProto_SentencePiece
+	scripts    map[rune]string
+}
+
+// Train trains a model on the lines of corpus following spec. The text is
+// normalized with normalizerSpec. When it is nil, the identity normalization
+// is used, which applies no NFKC rules unlike the nmt_nfkc default of
+// spm_train; pass the spec of a model with a precompiled charsmap to get them.
+func Train(corpus io.Reader, spec *sentencepiece.TrainerSpec, normalizerSpec *sentencepiece.NormalizerSpec) (*sentencepiece.ModelProto, error) {
+	if spec == nil {
+		spec = &sentencepiece.TrainerSpec{}
+	}
+	if normalizerSpec == nil {
+		normalizerSpec = &sentencepiece.NormalizerSpec{Name: proto.String("identity")}
+	}
+	t := &trainer{spec: spec, scripts: make(map[rune]string)}
+	if err := t.initMetaPieces(); err != nil {
+		return nil, err
+	}
+	if err := t.loadWords(corpus, normalizerSpec); err != nil {
+		return nil, err
+	}
+
+	var pieces []scoredPiece
+	var err error
+	switch spec.GetModelType() {
+	case sentencepiece.TrainerSpec_UNIGRAM:
+		pieces, err = t.trainUnigram()
+	case sentencepiece.TrainerSpec_BPE:
+		pieces, err = t.trainBPE()
+	default:
+		return nil, fmt.Errorf("Unable to train model type : %s", spec.GetModelType())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	model := &sentencepiece.ModelProto{
+		TrainerSpec:    proto.Clone(spec).(*sentencepiece.TrainerSpec),
+		NormalizerSpec: proto.Clone(normalizerSpec).(*sentencepiece.NormalizerSpec),
+	}
+	model.Pieces = append(model.Pieces, t.metaPieces...)
+	for _, piece := range pieces {
+		model.Pieces = append(model.Pieces, &sentencepiece.ModelProto_SentencePiece{
+			Piece: proto.String(piece.piece),
+			Score: proto.Float32(float32(piece.score)),
+			Type:  sentencepiece.ModelProto_SentencePiece_NORMAL.Enum(),
+		})
+	}
+	return model, nil
+}
+
+// initMetaPieces places the unknown, BOS, EOS and padding pieces at their ids,
+// and the control and user defined symbols, followed by the byte pieces, at
+// the remaining ids.
+func (t *trainer) initMetaPieces() error {
+	byID := make(map[int32]*sentencepiece.ModelProto_SentencePiece)
+	seen := make(map[string]bool)
+	add := func(id int32, piece string, typ sentencepiece.ModelProto_SentencePiece_Type) error {
+		if id < 0 {
+			return nil
+		}
+		if _, ok := byID[id]; ok || seen[piece] || piece == "" {
+			return fmt.Errorf("Unable to add meta piece : %s, id %d", piece, id)
+		}
+		byID[id] = &sentencepiece.ModelProto_SentencePiece{
+			Piece: proto.String(piece),
+			Score: proto.Float32(0),
+			Type:  typ.Enum(),
+		}
+		seen[piece] = true
+		return nil
+	}
+
+	spec := t.spec
+	if spec.GetUnkId() < 0 {
+		return fmt.Errorf("Unable to train without an unknown piece : unk_id %d", spec.GetUnkId())
+	}
+	specials := []struct {
+		id    int32
+		piece string
+		typ   sentencepiece.ModelProto_SentencePiece_Type
+	}{
+		{spec.GetUnkId(), spec.GetUnkPiece(), sentencepiece.ModelProto_SentencePiece_UNKNOWN},
+		{spec.GetBosId(), spec.GetBosPiece(), sentencepiece.ModelProto_SentencePiece_CONTROL},
+		{spec.GetEosId(), spec.GetEosPiece(), sentencepiece.ModelProto_SentencePiece_CONTROL},
+		{spec.GetPadId(), spec.GetPadPiece(), sentencepiece.ModelProto_SentencePiece_CONTROL},
+	}
+	for _, special := range specials {
+		if err := add(special.id, special.piece, special.typ); err != nil {
+			return err
+		}
+	}
+
+	nextID := int32(0)
+	addNext := func(piece string, typ sentencepiece.ModelProto_SentencePiece_Type) error {
+		for byID[nextID] != nil {
+			nextID++
+		}
+		return add(nextID, piece, typ)
+	}
+	for _, piece := range spec.GetControlSymbols() {
+		if err := addNext(piece, sentencepiece.ModelProto_SentencePiece_CONTROL); err != nil {
+			return err
+		}
+	}
+	for _, piece := range spec.GetUserDefinedSymbols() {
+		if err := addNext(piece, sentencepiece.ModelProto_SentencePiece_USER_DEFINED); err != nil {
+			return err
+		}
+	}
+	if spec.GetByteFallback() {
+		for b := 0; b < 256; b++ {
+			if err := addNext(fmt.Sprintf("<0x%02X>", b), sentencepiece.ModelProto_SentencePiece_BYTE); err != nil {
+				return err
+			}
+		}
+	}
+
+	t.metaPieces = make([]*sentencepiece.ModelProto_SentencePiece, len(byID))
+	for id, piece := range byID {
+		if int(id) >= len(byID) {
+			return fmt.Errorf("Unable to add meta piece : %s, id %d is not contiguous", piece.GetPiece(), id)
+		}
+		t.metaPieces[id] = piece
+	}
+	return nil
+}
+
+// loadWords reads and normalizes the sentences of corpus, splits them into
+// words and selects the characters covered by the vocab. The user defined
+// symbols are kept as is by the normalizer, like the encoder matches them, so
+// that only the start of a sentence gets the dummy prefix.
+func (t *trainer) loadWords(corpus io.Reader, normalizerSpec *sentencepiece.NormalizerSpec) error {
+	model := &sentencepiece.ModelProto{
+		TrainerSpec:    &sentencepiece.TrainerSpec{},
+		NormalizerSpec: normalizerSpec,
+	}
+	for _, symbol := range t.spec.GetUserDefinedSymbols() {
+		model.Pieces = append(model.Pieces, &sentencepiece.ModelProto_SentencePiece{
+			Piece: proto.String(symbol),
+			Type:  sentencepiece.ModelProto_SentencePiece_USER_DEFINED.Enum(),
+		})
+	}
+	normalizer, err := sentencepiece.NewSentencepieceFromModel(model, false)
+	if err != nil {
+		return err
+	}
+	normalizer.SetMatchUserDefined(true)
+
+	counts := make(map[string]int64)
+	reader := bufio.NewReader(corpus)
+	sentences := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("Unable to read corpus, err %v", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" && len(line) <= int(t.spec.GetMaxSentenceLength()) {
+			for _, text := range t.splitUserDefinedSymbols(normalizer.Normalize(line)) {
+				for _, w := range t.splitIntoWords(text) {
+					counts[w]++
+				}
+			}
+			sentences++
+		}
+		if err == io.EOF || (t.spec.GetInputSentenceSize() > 0 && sentences >= int(t.spec.GetInputSentenceSize())) {
+			break
+		}
+	}
+	if len(counts) == 0 {
+		return fmt.Errorf("Unable to train on an empty corpus")
+	}
+
+	keys := make([]string, 0, len(counts))
+	for w := range counts {
+		keys = append(keys, w)
+	}
+	sort.Strings(keys)
+	for _, w := range keys {
+		t.words = append(t.words, word{runes: []rune(w), freq: counts[w]})
+	}
+	t.selectRequiredChars()
+	return nil
+}
+
+// splitUserDefinedSymbols splits text around the user defined symbols, which
+// are pieces on their own and are left out of training.
+func (t *trainer) splitUserDefinedSymbols(text string) []string {
+	symbols := t.spec.GetUserDefinedSymbols()
+	if len(symbols) == 0 {
+		return []string{text}
+	}
+	var output []string
+	start := 0
+	for i := 0; i < len(text); {
+		length := 0
+		for _, symbol := range symbols {
+			if len(symbol) > length && strings.HasPrefix(text[i:], symbol) {
+				length = len(symbol)
+			}
+		}
+		if length == 0 {
+			_, size := utf8.DecodeRuneInString(text[i:])
+			i += size
+			continue
+		}
+		if start < i {
+			output = append(output, text[start:i])
+		}
+		i += length
+		start = i
+	}
+	if start < len(text) {
+		output = append(output, text[start:])
+	}
+	return output
+}
+
+// splitIntoWords splits normalized text at the whitespace when the spec
+// splits by whitespace. Words start with the whitespace, or end with it when
+// it is treated as a suffix.
+func (t *trainer) splitIntoWords(text string) []string {
+	if !t.spec.GetSplitByWhitespace() {
+		if text == "" {
+			return nil
+		}
+		return []string{text}
+	}
+	var words []string
+	start := 0
+	runes := []rune(text)
+	suffix := t.spec.GetTreatWhitespaceAsSuffix()
+	for i, r := range runes {
+		if r != wsChar {
+			continue
+		}
+		if suffix {
+			words = append(words, string(runes[start:i+1]))
+			start = i + 1
+		} else if i > start {
+			words = append(words, string(runes[start:i]))
+			start = i
+		}
+	}
+	if start < len(runes) {
+		words = append(words, string(runes[start:]))
+	}
+	return words
+}
+
+// selectRequiredChars selects the most frequent characters covering the
+// character coverage of the corpus, along with the required characters of
+// the spec. The other characters are replaced with unkChar.
+func (t *trainer) selectRequiredChars() {
+	chars := make(map[rune]int64)
+	total := int64(0)
+	for _, w := range t.words {
+		for _, r := range w.runes {
+			chars[r] += w.freq
+			total += w.freq
+		}
+	}
+	sorted := make([]scoredPiece, 0, len(chars))
+	for r, freq := range chars {
+		sorted = append(sorted, scoredPiece{piece: string(r), score: float64(freq)})
+	}
+	sortPieces(sorted)
+
+	coverage := float64(t.spec.GetCharacterCoverage())
+	t.required = make(map[rune]int64)
+	accumulated := int64(0)
+	for _, char := range sorted {
+		if coverage < 1 && float64(accumulated)/float64(total) >= coverage {
+			break
+		}
+		r, _ := utf8.DecodeRuneInString(char.piece)
+		if r == unkChar {
+			continue
+		}
+		accumulated += int64(char.score)
+		t.required[r] = int64(char.score)
+	}
+	for _, r := range t.spec.GetRequiredChars() {
+		if _, ok := t.required[r]; !ok {
+			t.required[r] = chars[r]
+		}
+	}
+
+	for _, w := range t.words {
+		for i, r := range w.runes {
+			if _, ok := t.required[r]; !ok {
+				w.runes[i] = unkChar
+			}
+		}
+	}
+}
+
+// isValidPiece returns whether runes can be a piece of the vocab, following
+// the length, whitespace, script and number options of the spec.
+func (t *trainer) isValidPiece(runes []rune) bool {
+	spec := t.spec
+	if len(runes) == 0 || len(runes) > int(spec.GetMaxSentencepieceLength()) {
+		return false
+	}
+	splitByWhitespace := spec.GetSplitByWhitespace()
+	suffix := spec.GetTreatWhitespaceAsSuffix()
+	last := len(runes) - 1
+	prevScript := ""
+	prevIsNumber := false
+	for i, r := range runes {
+		if r == unkChar || r <= 0 {
+			return false
+		}
+		if r == wsChar {
+			if suffix && ((splitByWhitespace && i < last) || (!splitByWhitespace && i == 0 && i < last)) {
+				return false
+			}
+			if !suffix && ((splitByWhitespace && i > 0) || (!splitByWhitespace && i > 0 && i == last)) {
+				return false
+			}
+			continue
+		}
+		isNumber := unicode.IsDigit(r)
+		if isNumber && spec.GetSplitDigits() && len(runes) > 1 {
+			return false
+		}
+		if spec.GetSplitByNumber() && i > 0 && runes[i-1] != wsChar && isNumber != prevIsNumber {
+			return false
+		}
+		prevIsNumber = isNumber
+		if isNumber {
+			// Numbers are only split from the other characters by split_by_number.
+			continue
+		}
+		script := t.script(r)
+		if spec.GetSplitByUnicodeScript() && prevScript != "" && script != prevScript {
+			return false
+		}
+		prevScript = script
+	}
+	return true
+}
+
+// script returns the Unicode script of r, with Hiragana and Katakana merged
+// into Han like the C++ trainer.
+func (t *trainer) script(r rune) string {
+	if script, ok := t.scripts[r]; ok {
+		return script
+	}
+	script := "Common"
+	if r == 0x30FC {
+		script = "Han"
+	} else {
+		for name, table := range unicode.Scripts {
+			if unicode.Is(table, r) {
+				script = name
+				break
+			}
+		}
+		if script == "Hiragana" || script == "Katakana" {
+			script = "Han"
+		}
+	}
+	t.scripts[r] = script
+	return script
+}
+
+// finalizePieces returns the pieces of the vocab: the required characters
+// and the pieces with the highest scores, sorted by score.
+func (t *trainer) finalizePieces(pieces []scoredPiece) ([]scoredPiece, error) {
+	size := int(t.spec.GetVocabSize()) - len(t.metaPieces)
+	if size < len(t.required) {
+		return nil, fmt.Errorf("Unable to fit the required characters : %d, vocab size %d", len(t.required)+len(t.metaPieces), t.spec.GetVocabSize())
+	}
+
+	isMeta := make(map[string]bool)
+	for _, piece := range t.metaPieces {
+		isMeta[piece.GetPiece()] = true
+	}
+	scores := make(map[string]float64)
+	minScore := 0.0
+	for _, piece := range pieces {
+		scores[piece.piece] = piece.score
+		if piece.score < minScore {
+			minScore = piece.score
+		}
+	}
+
+	chars := make([]scoredPiece, 0, len(t.required))
+	for r, freq := range t.required {
+		chars = append(chars, scoredPiece{piece: string(r), score: float64(freq)})
+	}
+	sortPieces(chars)
+	final := make(map[string]float64)
+	penalty := 0.0
+	for _, char := range chars {
+		if isMeta[char.piece] {
+			continue
+		}
+		if score, ok := scores[char.piece]; ok {
+			final[char.piece] = score
+			continue
+		}
+		// Characters which were pruned get scores below all the pieces.
+		penalty -= 0.0001
+		final[char.piece] = minScore + penalty
+	}
+
+	sorted := append([]scoredPiece(nil), pieces...)
+	sortPieces(sorted)
+	for _, piece := range sorted {
+		if len(final) >= size {
+			break
+		}
+		if _, ok := final[piece.piece]; !ok && !isMeta[piece.piece] {
+			final[piece.piece] = piece.score
+		}
+	}
+	if len(final) < size && t.spec.GetHardVocabLimit() {
+		return nil, fmt.Errorf("Unable to fill the vocab : vocab size %d, only %d pieces found", t.spec.GetVocabSize(), len(final)+len(t.metaPieces))
+	}
+
+	output := make([]scoredPiece, 0, len(final))
+	for piece, score := range final {
+		output = append(output, scoredPiece{piece: piece, score: score})
+	}
+	sortPieces(output)
+	return output, nil
+}
+
+// sortPieces sorts pieces by decreasing score, and by piece for equal scores
+func sortPieces(pieces []scoredPiece) {
+	sort.Slice(pieces, func(i, j int) bool {
+		if pieces[i].score != pieces[j].score {
+			return pieces[i].score > pieces[j].score
+		}
+		return pieces[i].piece < pieces[j].piece
+	})
+}
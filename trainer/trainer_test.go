@@ -0,0 +1,298 @@
+package trainer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/susanhuhu/go-sentencepiece-encoder/sentencepiece"
+	"google.golang.org/protobuf/proto"
+)
+
+var testCorpus = strings.Repeat(`the quick brown fox jumps over the lazy dog
+a quick movie about the brown dog was shown in the evening
+the office meeting is moved to next week because of the holidays
+we will be running late to the office today
+the dog and the fox are sleeping in the sun
+the lazy fox was not jumping today
+please send the report to the office before the meeting
+the weather is sunny and warm in the evening
+this movie got a very good review from the critics
+numbers like 2023 and 42 appear in the text
+`, 3) + "жук\n"
+
+func newTestSpec(modelType sentencepiece.TrainerSpec_ModelType, vocabSize int32) *sentencepiece.TrainerSpec {
+	return &sentencepiece.TrainerSpec{
+		ModelType: modelType.Enum(),
+		VocabSize: proto.Int32(vocabSize),
+	}
+}
+
+func trainTestModel(t *testing.T, spec *sentencepiece.TrainerSpec) (*sentencepiece.ModelProto, sentencepiece.Sentencepiece) {
+	model, err := Train(strings.NewReader(testCorpus), spec, nil)
+	if err != nil {
+		t.Fatalf("Unable to train model : %v", err)
+	}
+	bytes, err := proto.Marshal(model)
+	if err != nil {
+		t.Fatalf("Unable to marshal model : %v", err)
+	}
+	sp, err := sentencepiece.NewSentencepieceFromBytes(bytes, false)
+	if err != nil {
+		t.Fatalf("Unable to load trained model : %v", err)
+	}
+	return model, sp
+}
+
+func checkRoundTrip(t *testing.T, sp sentencepiece.Sentencepiece) {
+	for _, line := range strings.Split(strings.TrimSpace(testCorpus), "\n") {
+		ids := sp.TokenizeToIDs(line)
+		for _, id := range ids {
+			if sp.IsUnknown(id) {
+				t.Errorf("Tokenize(%q) got unknown pieces : %v", line, sp.Tokenize(line))
+				break
+			}
+		}
+		if decoded, err := sp.DecodeIDs(ids); err != nil || decoded != line {
+			t.Errorf("DecodeIDs(TokenizeToIDs(%q)) got %q, err %v", line, decoded, err)
+		}
+	}
+}
+
+func TestTrainUnigram(t *testing.T) {
+	spec := newTestSpec(sentencepiece.TrainerSpec_UNIGRAM, 80)
+	spec.ControlSymbols = []string{"<cls>"}
+	spec.UserDefinedSymbols = []string{"<mask>"}
+	spec.MaxSentencepieceLength = proto.Int32(6)
+	model, sp := trainTestModel(t, spec)
+
+	if len(model.GetPieces()) != 80 {
+		t.Errorf("Trained %d pieces, expected 80", len(model.GetPieces()))
+	}
+	metas := []string{"<unk>", "<s>", "</s>", "<cls>", "<mask>"}
+	types := []sentencepiece.ModelProto_SentencePiece_Type{
+		sentencepiece.ModelProto_SentencePiece_UNKNOWN,
+		sentencepiece.ModelProto_SentencePiece_CONTROL,
+		sentencepiece.ModelProto_SentencePiece_CONTROL,
+		sentencepiece.ModelProto_SentencePiece_CONTROL,
+		sentencepiece.ModelProto_SentencePiece_USER_DEFINED,
+	}
+	for i, meta := range metas {
+		if piece := model.GetPieces()[i]; piece.GetPiece() != meta || piece.GetType() != types[i] {
+			t.Errorf("Piece %d got %q of type %v, expected %q of type %v", i, piece.GetPiece(), piece.GetType(), meta, types[i])
+		}
+	}
+	seen := make(map[string]bool)
+	prevScore := float32(0)
+	for i, piece := range model.GetPieces() {
+		if seen[piece.GetPiece()] {
+			t.Errorf("Piece %q is duplicated", piece.GetPiece())
+		}
+		seen[piece.GetPiece()] = true
+		if i < len(metas) {
+			continue
+		}
+		if length := len([]rune(piece.GetPiece())); length > 6 {
+			t.Errorf("Piece %q is longer than the max piece length", piece.GetPiece())
+		}
+		if piece.GetScore() >= 0 || (i > len(metas) && piece.GetScore() > prevScore) {
+			t.Errorf("Piece %q has score %v after %v, expected decreasing log probabilities", piece.GetPiece(), piece.GetScore(), prevScore)
+		}
+		prevScore = piece.GetScore()
+	}
+	for _, piece := range []string{"the", "e", "▁"} {
+		if !seen[piece] {
+			t.Errorf("Piece %q is missing from the vocab", piece)
+		}
+	}
+	checkRoundTrip(t, sp)
+
+	sp.SetMatchUserDefined(true)
+	if tokens := sp.Tokenize("the<mask>dog"); !containsID(tokens, sp.PieceToID("<mask>")) {
+		t.Errorf("Tokenize with a user defined symbol got %v", tokens)
+	}
+}
+
+func containsID(tokens []sentencepiece.Token, id int32) bool {
+	for _, token := range tokens {
+		if token.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTrainBPE(t *testing.T) {
+	spec := newTestSpec(sentencepiece.TrainerSpec_BPE, 100)
+	spec.UserDefinedSymbols = []string{"<mask>"}
+	model, sp := trainTestModel(t, spec)
+
+	if len(model.GetPieces()) != 100 {
+		t.Errorf("Trained %d pieces, expected 100", len(model.GetPieces()))
+	}
+	pieces := model.GetPieces()[4:]
+	for i, piece := range pieces {
+		if piece.GetScore() != -float32(i) {
+			t.Errorf("Piece %q has score %v, expected the merge order %v", piece.GetPiece(), piece.GetScore(), -float32(i))
+		}
+	}
+	if first := pieces[0].GetPiece(); first != "\u2581t" && first != "he" && first != "th" {
+		t.Errorf("First merge got %q, expected one of the most frequent pairs", first)
+	}
+	checkRoundTrip(t, sp)
+	if tokens := sp.Tokenize("the office"); len(tokens) != 2 {
+		t.Errorf("Tokenize(%q) got %v, expected frequent words to be merged", "the office", tokens)
+	}
+}
+
+func TestTrainBPESplits(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(spec *sentencepiece.TrainerSpec)
+		invalid func(piece string) bool
+	}{
+		{
+			name:   "split_by_whitespace",
+			modify: func(spec *sentencepiece.TrainerSpec) {},
+			invalid: func(piece string) bool {
+				return strings.LastIndex(piece, "\u2581") > 0
+			},
+		},
+		{
+			name: "split_digits",
+			modify: func(spec *sentencepiece.TrainerSpec) {
+				spec.SplitDigits = proto.Bool(true)
+			},
+			invalid: func(piece string) bool {
+				return strings.ContainsAny(piece, "0123456789") && len(strings.Trim(piece, "0123456789\u2581")) == 0 && len(strings.Trim(piece, "\u2581")) > 1
+			},
+		},
+	}
+	for _, test := range tests {
+		spec := newTestSpec(sentencepiece.TrainerSpec_BPE, 150)
+		spec.HardVocabLimit = proto.Bool(false)
+		test.modify(spec)
+		model, sp := trainTestModel(t, spec)
+		for _, piece := range model.GetPieces() {
+			if test.invalid(piece.GetPiece()) {
+				t.Errorf("Training with %s got piece %q", test.name, piece.GetPiece())
+			}
+		}
+		checkRoundTrip(t, sp)
+	}
+
+	spec := newTestSpec(sentencepiece.TrainerSpec_BPE, 150)
+	spec.SplitByWhitespace = proto.Bool(false)
+	model, _ := trainTestModel(t, spec)
+	found := false
+	for _, piece := range model.GetPieces() {
+		found = found || strings.LastIndex(piece.GetPiece(), "\u2581") > 0
+	}
+	if !found {
+		t.Errorf("Training without split_by_whitespace got no piece spanning whitespace")
+	}
+}
+
+func TestCharacterCoverage(t *testing.T) {
+	spec := newTestSpec(sentencepiece.TrainerSpec_UNIGRAM, 60)
+	spec.CharacterCoverage = proto.Float32(0.995)
+	_, sp := trainTestModel(t, spec)
+	if id := sp.PieceToID("ж"); !sp.IsUnknown(id) {
+		t.Errorf("Rare character ж got id %d, expected it to be left out by the character coverage", id)
+	}
+
+	spec.CharacterCoverage = proto.Float32(1)
+	_, sp = trainTestModel(t, spec)
+	if id := sp.PieceToID("ж"); sp.IsUnknown(id) {
+		t.Errorf("Rare character ж is missing with full character coverage")
+	}
+}
+
+func TestLoadWords(t *testing.T) {
+	spec := &sentencepiece.TrainerSpec{UserDefinedSymbols: []string{"<mask>"}}
+	tr := &trainer{spec: spec, scripts: make(map[rune]string)}
+	if err := tr.loadWords(strings.NewReader("the<mask>dog\nthe <mask> cat\n"), nil); err != nil {
+		t.Fatalf("loadWords got err %v", err)
+	}
+	found := make(map[string]int64)
+	for _, w := range tr.words {
+		found[string(w.runes)] = w.freq
+	}
+	expected := map[string]int64{"▁the": 2, "dog": 1, "▁": 1, "▁cat": 1}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("loadWords got %v, expected %v", found, expected)
+	}
+}
+
+func TestTrainErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		corpus string
+		spec   *sentencepiece.TrainerSpec
+	}{
+		{name: "empty corpus", corpus: "", spec: newTestSpec(sentencepiece.TrainerSpec_UNIGRAM, 50)},
+		{name: "vocab too small", corpus: testCorpus, spec: newTestSpec(sentencepiece.TrainerSpec_UNIGRAM, 10)},
+		{name: "vocab too large", corpus: testCorpus, spec: newTestSpec(sentencepiece.TrainerSpec_UNIGRAM, 100000)},
+		{name: "duplicate meta piece", corpus: testCorpus, spec: &sentencepiece.TrainerSpec{ControlSymbols: []string{"<s>"}}},
+		{name: "unsupported model type", corpus: testCorpus, spec: newTestSpec(sentencepiece.TrainerSpec_CHAR, 50)},
+	}
+	for _, test := range tests {
+		if _, err := Train(strings.NewReader(test.corpus), test.spec, nil); err == nil {
+			t.Errorf("Train with %s got no error", test.name)
+		}
+	}
+}
+
+func TestIsValidPiece(t *testing.T) {
+	tests := []struct {
+		piece    string
+		modify   func(spec *sentencepiece.TrainerSpec)
+		expected bool
+	}{
+		{piece: "▁the", expected: true},
+		{piece: "th▁e", expected: false},
+		{piece: "th▁e", modify: func(spec *sentencepiece.TrainerSpec) { spec.SplitByWhitespace = proto.Bool(false) }, expected: true},
+		{piece: "the▁", modify: func(spec *sentencepiece.TrainerSpec) { spec.TreatWhitespaceAsSuffix = proto.Bool(true) }, expected: true},
+		{piece: "▁abcdefghijklmnopq", expected: false},
+		{piece: "▁a1", expected: false},
+		{piece: "▁a1", modify: func(spec *sentencepiece.TrainerSpec) { spec.SplitByNumber = proto.Bool(false) }, expected: true},
+		{piece: "▁42", expected: true},
+		{piece: "▁42", modify: func(spec *sentencepiece.TrainerSpec) { spec.SplitDigits = proto.Bool(true) }, expected: false},
+		{piece: "▁a1", modify: func(spec *sentencepiece.TrainerSpec) {
+			spec.SplitByNumber = proto.Bool(false)
+			spec.SplitDigits = proto.Bool(true)
+		}, expected: false},
+		{piece: "4", modify: func(spec *sentencepiece.TrainerSpec) { spec.SplitDigits = proto.Bool(true) }, expected: true},
+		{piece: "▁aΨ", expected: false},
+		{piece: "▁aΨ", modify: func(spec *sentencepiece.TrainerSpec) { spec.SplitByUnicodeScript = proto.Bool(false) }, expected: true},
+		{piece: "漢字かな", expected: true},
+		{piece: "a▅", expected: false},
+	}
+	for _, test := range tests {
+		spec := &sentencepiece.TrainerSpec{}
+		if test.modify != nil {
+			test.modify(spec)
+		}
+		tr := &trainer{spec: spec, scripts: make(map[rune]string)}
+		if valid := tr.isValidPiece([]rune(test.piece)); valid != test.expected {
+			t.Errorf("isValidPiece(%q) got %v, expected %v", test.piece, valid, test.expected)
+		}
+	}
+}
+
+func TestRepeatedSubstrings(t *testing.T) {
+	text := []int32{'a', 'b', 'a', 'b', 'c', -1, 'a', 'b', 'c', -2}
+	weights := []int64{1, 1, 1, 1, 1, 1, 10, 10, 10, 10}
+	found := make(map[string]int64)
+	for _, substring := range repeatedSubstrings(text, weights) {
+		var sb strings.Builder
+		for _, r := range text[substring.start : substring.start+substring.length] {
+			sb.WriteRune(rune(r))
+		}
+		found[sb.String()] = substring.freq
+	}
+	expected := map[string]int64{"ab": 12, "abc": 11, "b": 12, "bc": 11, "c": 11}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("repeatedSubstrings got %v, expected %v", found, expected)
+	}
+}
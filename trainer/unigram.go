@@ -0,0 +1,399 @@
+package trainer
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	// expectedFrequencyThreshold is the expected frequency below which the
+	// M-step drops a piece.
+	expectedFrequencyThreshold = 0.5
+	// unknownPenalty is the score of unknown characters below the lowest piece
+	unknownPenalty = 10.0
+)
+
+// unigramModel holds the pieces and their log probabilities during training
+type unigramModel struct {
+	pieces   []scoredPiece
+	trie     []unigramTrieNode
+	minScore float64
+}
+
+type unigramTrieNode struct {
+	children map[rune]int32
+	index    int
+}
+
+type unigramNode struct {
+	start int
+	end   int
+	index int
+	score float64
+}
+
+// unigramLattice holds the nodes of the segmentations of a word
+type unigramLattice struct {
+	nodes    []unigramNode
+	beginsAt [][]int
+	endsAt   [][]int
+}
+
+func newUnigramModel(pieces []scoredPiece) *unigramModel {
+	m := &unigramModel{
+		pieces: pieces,
+		trie:   []unigramTrieNode{{children: make(map[rune]int32), index: -1}},
+	}
+	for i, piece := range pieces {
+		if i == 0 || piece.score < m.minScore {
+			m.minScore = piece.score
+		}
+		node := 0
+		for _, r := range piece.piece {
+			child, ok := m.trie[node].children[r]
+			if !ok {
+				child = int32(len(m.trie))
+				m.trie[node].children[r] = child
+				m.trie = append(m.trie, unigramTrieNode{children: make(map[rune]int32), index: -1})
+			}
+			node = int(child)
+		}
+		m.trie[node].index = i
+	}
+	return m
+}
+
+// lattice returns the lattice of runes. Characters which are not pieces get
+// an unknown node, with index -1.
+func (m *unigramModel) lattice(runes []rune) *unigramLattice {
+	l := &unigramLattice{
+		beginsAt: make([][]int, len(runes)+1),
+		endsAt:   make([][]int, len(runes)+1),
+	}
+	add := func(node unigramNode) {
+		l.beginsAt[node.start] = append(l.beginsAt[node.start], len(l.nodes))
+		l.endsAt[node.end] = append(l.endsAt[node.end], len(l.nodes))
+		l.nodes = append(l.nodes, node)
+	}
+	for start := range runes {
+		hasSingle := false
+		node := 0
+		for end := start; end < len(runes); end++ {
+			child, ok := m.trie[node].children[runes[end]]
+			if !ok {
+				break
+			}
+			node = int(child)
+			if index := m.trie[node].index; index >= 0 {
+				add(unigramNode{start: start, end: end + 1, index: index, score: m.pieces[index].score})
+				hasSingle = hasSingle || end == start
+			}
+		}
+		if !hasSingle {
+			add(unigramNode{start: start, end: start + 1, index: -1, score: m.minScore - unknownPenalty})
+		}
+	}
+	return l
+}
+
+// viterbi returns the nodes of the best segmentation, skipping the node
+// excluded unless it is negative. It returns false if there is no other
+// segmentation.
+func (l *unigramLattice) viterbi(excluded int) ([]unigramNode, bool) {
+	length := len(l.endsAt) - 1
+	best := make([]float64, length+1)
+	back := make([]int, length+1)
+	for pos := 1; pos <= length; pos++ {
+		best[pos] = math.Inf(-1)
+		back[pos] = -1
+		for _, index := range l.endsAt[pos] {
+			node := l.nodes[index]
+			if index == excluded || (node.start > 0 && back[node.start] < 0) {
+				continue
+			}
+			if score := best[node.start] + node.score; back[pos] < 0 || score > best[pos] {
+				best[pos] = score
+				back[pos] = index
+			}
+		}
+	}
+	if length > 0 && back[length] < 0 {
+		return nil, false
+	}
+	var path []unigramNode
+	for pos := length; pos > 0; {
+		node := l.nodes[back[pos]]
+		path = append(path, node)
+		pos = node.start
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path, true
+}
+
+// marginals adds to expected the expected counts of the pieces in the
+// segmentations of the lattice, weighted by freq, and returns the log
+// likelihood of the word.
+func (l *unigramLattice) marginals(freq float64, expected []float64) float64 {
+	length := len(l.endsAt) - 1
+	alpha := make([]float64, length+1)
+	beta := make([]float64, length+1)
+	for pos := 1; pos <= length; pos++ {
+		alpha[pos] = math.Inf(-1)
+		for _, index := range l.endsAt[pos] {
+			node := l.nodes[index]
+			alpha[pos] = logSumExp(alpha[pos], alpha[node.start]+node.score)
+		}
+	}
+	for pos := length - 1; pos >= 0; pos-- {
+		beta[pos] = math.Inf(-1)
+		for _, index := range l.beginsAt[pos] {
+			node := l.nodes[index]
+			beta[pos] = logSumExp(beta[pos], node.score+beta[node.end])
+		}
+	}
+	z := alpha[length]
+	for _, node := range l.nodes {
+		if node.index < 0 {
+			continue
+		}
+		expected[node.index] += freq * math.Exp(alpha[node.start]+node.score+beta[node.end]-z)
+	}
+	return z
+}
+
+func logSumExp(x, y float64) float64 {
+	if math.IsInf(x, -1) {
+		return y
+	}
+	if math.IsInf(y, -1) {
+		return x
+	}
+	if x < y {
+		x, y = y, x
+	}
+	return x + math.Log1p(math.Exp(y-x))
+}
+
+// digamma approximates the digamma function with its asymptotic expansion
+func digamma(x float64) float64 {
+	result := 0.0
+	for ; x < 7; x++ {
+		result -= 1 / x
+	}
+	x -= 0.5
+	xx := 1 / x
+	xx2 := xx * xx
+	xx4 := xx2 * xx2
+	result += math.Log(x) + xx2/24 - 7*xx4/960 + 31*xx4*xx2/8064 - 127*xx4*xx4/30720
+	return result
+}
+
+// trainUnigram trains a unigram model with EM, starting from the most
+// frequent substrings of the corpus and pruning the pieces which least
+// reduce the likelihood when removed, until the vocab size is reached.
+func (t *trainer) trainUnigram() ([]scoredPiece, error) {
+	model := newUnigramModel(t.seedPieces())
+	desiredSize := int(float64(t.spec.GetVocabSize()) * 1.1)
+	for {
+		for i := 0; i < int(t.spec.GetNumSubIterations()); i++ {
+			expected := t.expectation(model)
+			model = newUnigramModel(maximization(model.pieces, expected))
+		}
+		if len(model.pieces) <= desiredSize {
+			break
+		}
+		pruned := t.prune(model, desiredSize)
+		if len(pruned) == len(model.pieces) {
+			break
+		}
+		model = newUnigramModel(pruned)
+	}
+	return t.finalizePieces(model.pieces)
+}
+
+// seedPieces returns the required characters and the most frequent
+// substrings of the words, scored by their log probabilities. Every
+// occurrence of a substring counts as many times as its word is in the
+// corpus.
+func (t *trainer) seedPieces() []scoredPiece {
+	var text []int32
+	var weights []int64
+	for i, w := range t.words {
+		for _, r := range w.runes {
+			text = append(text, int32(r))
+			weights = append(weights, w.freq)
+		}
+		// Distinct separators keep the substrings within the words.
+		text = append(text, int32(-i-1))
+		weights = append(weights, w.freq)
+	}
+
+	var pieces []scoredPiece
+	for r, freq := range t.required {
+		pieces = append(pieces, scoredPiece{piece: string(r), score: float64(freq)})
+	}
+	sortPieces(pieces)
+
+	var substrings []scoredPiece
+	runes := make([]rune, 0, t.spec.GetMaxSentencepieceLength())
+	for _, substring := range repeatedSubstrings(text, weights) {
+		if substring.length <= 1 || substring.length > int(t.spec.GetMaxSentencepieceLength()) {
+			continue
+		}
+		runes = runes[:0]
+		for _, r := range text[substring.start : substring.start+substring.length] {
+			runes = append(runes, rune(r))
+		}
+		if !t.isValidPiece(runes) {
+			continue
+		}
+		substrings = append(substrings, scoredPiece{piece: string(runes), score: float64(substring.freq * int64(substring.length))})
+	}
+	sortPieces(substrings)
+	for _, substring := range substrings {
+		if len(pieces) >= int(t.spec.GetSeedSentencepieceSize()) {
+			break
+		}
+		pieces = append(pieces, substring)
+	}
+
+	sum := 0.0
+	for _, piece := range pieces {
+		sum += piece.score
+	}
+	logSum := math.Log(sum)
+	for i := range pieces {
+		pieces[i].score = math.Log(pieces[i].score) - logSum
+	}
+	return pieces
+}
+
+// expectation returns the expected counts of the pieces in the words
+func (t *trainer) expectation(model *unigramModel) []float64 {
+	expected := make([]float64, len(model.pieces))
+	for _, w := range t.words {
+		model.lattice(w.runes).marginals(float64(w.freq), expected)
+	}
+	return expected
+}
+
+// maximization drops the pieces with a low expected count and scores the
+// others with the digamma of their counts, like Bayesian EM.
+func maximization(pieces []scoredPiece, expected []float64) []scoredPiece {
+	var output []scoredPiece
+	sum := 0.0
+	for i, piece := range pieces {
+		if expected[i] < expectedFrequencyThreshold {
+			continue
+		}
+		output = append(output, scoredPiece{piece: piece.piece, score: expected[i]})
+		sum += expected[i]
+	}
+	logSum := digamma(sum)
+	for i := range output {
+		output[i].score = digamma(output[i].score) - logSum
+	}
+	return output
+}
+
+// prune keeps the pieces whose removal most reduces the likelihood of the
+// Viterbi segmentations of the words, shrinking the vocab by the shrinking
+// factor but not below desiredSize.
+func (t *trainer) prune(model *unigramModel, desiredSize int) []scoredPiece {
+	pieces := model.pieces
+	alwaysKeep := make([]bool, len(pieces))
+	alternatives := make([][]int, len(pieces))
+	for i, piece := range pieces {
+		l := model.lattice([]rune(piece.piece))
+		best, _ := l.viterbi(-1)
+		if len(best) != 1 {
+			// The piece is not its own best segmentation, so it is never used.
+			continue
+		}
+		alwaysKeep[i] = true
+		self := -1
+		for index, node := range l.nodes {
+			if node.index == i && node.start == 0 && node.end == len(l.endsAt)-1 {
+				self = index
+			}
+		}
+		second, ok := l.viterbi(self)
+		if !ok {
+			continue
+		}
+		for _, node := range second {
+			if node.index < 0 {
+				alternatives[i] = nil
+				break
+			}
+			alternatives[i] = append(alternatives[i], node.index)
+		}
+	}
+
+	freq := make([]float64, len(pieces))
+	inverted := make([][]int, len(pieces))
+	sum := 0.0
+	for i, w := range t.words {
+		path, _ := model.lattice(w.runes).viterbi(-1)
+		for _, node := range path {
+			if node.index < 0 {
+				continue
+			}
+			freq[node.index] += float64(w.freq)
+			inverted[node.index] = append(inverted[node.index], i)
+			sum += float64(w.freq)
+		}
+	}
+	logSum := math.Log(sum)
+
+	var kept, candidates []scoredPiece
+	var candidateIndices []int
+	for i, piece := range pieces {
+		switch {
+		case freq[i] == 0 || !alwaysKeep[i]:
+			// The piece is not used by the segmentations, so it can be removed.
+		case len(alternatives[i]) == 0:
+			kept = append(kept, piece)
+		default:
+			f := 0.0
+			for _, n := range inverted[i] {
+				f += float64(t.words[n].freq)
+			}
+			f /= sum
+			logProb := math.Log(freq[i]) - logSum
+			// Without the piece its frequency goes to its alternatives.
+			logSumAlt := math.Log(sum + freq[i]*float64(len(alternatives[i])-1))
+			logProbAlt := 0.0
+			for _, n := range alternatives[i] {
+				logProbAlt += math.Log(freq[n]+freq[i]) - logSumAlt
+			}
+			candidates = append(candidates, scoredPiece{piece: piece.piece, score: f * (logProb - logProbAlt)})
+			candidateIndices = append(candidateIndices, i)
+		}
+	}
+
+	order := make([]int, len(candidates))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		x, y := candidates[order[a]], candidates[order[b]]
+		if x.score != y.score {
+			return x.score > y.score
+		}
+		return x.piece < y.piece
+	})
+	size := int(float64(t.spec.GetShrinkingFactor()) * float64(len(pieces)))
+	if size < desiredSize {
+		size = desiredSize
+	}
+	for _, i := range order {
+		if len(kept) >= size {
+			break
+		}
+		kept = append(kept, pieces[candidateIndices[i]])
+	}
+	return kept
+}